@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"math/bits"
+	"strings"
+
+	"test/db"
+)
+
+var (
+	ErrAmountOverflow     = errors.New("amount overflows 128 bits")
+	ErrAmountUnderflow    = errors.New("amount would go below zero")
+	ErrAmountNotCanonical = errors.New("amount is not in canonical form")
+	ErrAmountZero         = errors.New("amount must be positive")
+)
+
+// maxAmountDecimals bounds the decimals of an asset, 10^38 being the largest
+// power of ten that fits in 128 bits
+const maxAmountDecimals = 38
+
+// Amount is a non-negative quantity of base units with the same 128-bit range
+// as TigerBeetle's Uint128. Arithmetic is checked and never wraps around.
+type Amount struct {
+	hi, lo uint64
+}
+
+// NewAmount returns an amount of v base units
+func NewAmount(v uint64) Amount {
+	return Amount{lo: v}
+}
+
+// Add returns a + b, failing if the sum overflows 128 bits
+func (a Amount) Add(b Amount) (Amount, error) {
+	lo, carry := bits.Add64(a.lo, b.lo, 0)
+	hi, carry := bits.Add64(a.hi, b.hi, carry)
+	if carry != 0 {
+		return Amount{}, ErrAmountOverflow
+	}
+	return Amount{hi: hi, lo: lo}, nil
+}
+
+// Sub returns a - b, failing if b is larger than a
+func (a Amount) Sub(b Amount) (Amount, error) {
+	lo, borrow := bits.Sub64(a.lo, b.lo, 0)
+	hi, borrow := bits.Sub64(a.hi, b.hi, borrow)
+	if borrow != 0 {
+		return Amount{}, ErrAmountUnderflow
+	}
+	return Amount{hi: hi, lo: lo}, nil
+}
+
+// Cmp returns -1, 0 or 1 if a is less than, equal to or greater than b
+func (a Amount) Cmp(b Amount) int {
+	switch {
+	case a.hi < b.hi || (a.hi == b.hi && a.lo < b.lo):
+		return -1
+	case a == b:
+		return 0
+	}
+	return 1
+}
+
+func (a Amount) IsZero() bool { return a.hi == 0 && a.lo == 0 }
+
+// Uint64 returns the amount as a uint64 and whether it fits
+func (a Amount) Uint64() (uint64, bool) {
+	return a.lo, a.hi == 0
+}
+
+// ledgerAmount converts the amount for backends with native transfers
+func (a Amount) ledgerAmount() db.Uint128 {
+	return db.Uint128{Hi: a.hi, Lo: a.lo}
+}
+
+func (a Amount) bigInt() *big.Int {
+	n := new(big.Int).SetUint64(a.hi)
+	n.Lsh(n, 64)
+	return n.Or(n, new(big.Int).SetUint64(a.lo))
+}
+
+// String returns the number of base units in decimal, the form amounts are
+// stored in
+func (a Amount) String() string {
+	if a.hi == 0 {
+		return new(big.Int).SetUint64(a.lo).String()
+	}
+	return a.bigInt().String()
+}
+
+// Format returns the canonical decimal form of the amount for an asset with
+// the given number of decimals: no leading zeros in the integer part and no
+// trailing zeros in the fractional part
+func (a Amount) Format(decimals uint8) string {
+	s := a.String()
+	if decimals == 0 {
+		return s
+	}
+	if len(s) <= int(decimals) {
+		s = strings.Repeat("0", int(decimals)-len(s)+1) + s
+	}
+	integer, fraction := s[:len(s)-int(decimals)], strings.TrimRight(s[len(s)-int(decimals):], "0")
+	if fraction == "" {
+		return integer
+	}
+	return integer + "." + fraction
+}
+
+// ParseAmount parses the canonical decimal form of an amount of an asset with
+// the given number of decimals, as produced by Format. Forms such as "050",
+// "1.50", ".5" or "1e3" are rejected so that every amount has exactly one
+// signed representation.
+func ParseAmount(s string, decimals uint8) (Amount, error) {
+	integer, fraction, hasFraction := strings.Cut(s, ".")
+	if integer == "" || !isDigits(integer) || (len(integer) > 1 && integer[0] == '0') {
+		return Amount{}, ErrAmountNotCanonical
+	}
+	if hasFraction {
+		if fraction == "" || !isDigits(fraction) || len(fraction) > int(decimals) || strings.HasSuffix(fraction, "0") {
+			return Amount{}, ErrAmountNotCanonical
+		}
+	}
+
+	digits := integer + fraction + strings.Repeat("0", int(decimals)-len(fraction))
+	n, ok := new(big.Int).SetString(digits, 10)
+	if !ok {
+		return Amount{}, ErrAmountNotCanonical
+	}
+	return amountFromBig(n)
+}
+
+// amountFromBig converts a non-negative integer to an amount, failing if it
+// overflows 128 bits
+func amountFromBig(n *big.Int) (Amount, error) {
+	if n.Sign() < 0 {
+		return Amount{}, ErrAmountUnderflow
+	}
+	if n.BitLen() > 128 {
+		return Amount{}, ErrAmountOverflow
+	}
+	lo := new(big.Int).And(n, new(big.Int).SetUint64(^uint64(0))).Uint64()
+	hi := new(big.Int).Rsh(n, 64).Uint64()
+	return Amount{hi: hi, lo: lo}, nil
+}
+
+// ParsePositiveAmount parses an amount with ParseAmount and rejects zero
+func ParsePositiveAmount(s string, decimals uint8) (Amount, error) {
+	amount, err := ParseAmount(s, decimals)
+	if err == nil && amount.IsZero() {
+		return Amount{}, ErrAmountZero
+	}
+	return amount, err
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// MarshalJSON encodes the amount as a string of base units, since JSON
+// numbers lose precision above 2^53 in most decoders
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.String())
+}
+
+// UnmarshalJSON decodes a string of base units
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	amount, err := ParseAmount(s, 0)
+	if err != nil {
+		return err
+	}
+	*a = amount
+	return nil
+}
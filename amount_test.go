@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+)
+
+// maxAmount is 2^128 - 1, the largest amount
+var maxAmount = Amount{hi: math.MaxUint64, lo: math.MaxUint64}
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		s        string
+		decimals uint8
+		want     Amount
+		err      error
+	}{
+		{"0", 0, Amount{}, nil},
+		{"50", 0, NewAmount(50), nil},
+		{"1.5", 2, NewAmount(150), nil},
+		{"0.05", 2, NewAmount(5), nil},
+		{"18446744073709551616", 0, Amount{hi: 1}, nil},
+		{"340282366920938463463374607431768211455", 0, maxAmount, nil},
+		{"340282366920938463463374607431768211456", 0, Amount{}, ErrAmountOverflow},
+		{"3402823669209384634633746074317682114.56", 2, Amount{}, ErrAmountOverflow},
+		{"050", 0, Amount{}, ErrAmountNotCanonical},
+		{"00", 0, Amount{}, ErrAmountNotCanonical},
+		{"", 0, Amount{}, ErrAmountNotCanonical},
+		{"-1", 0, Amount{}, ErrAmountNotCanonical},
+		{"+1", 0, Amount{}, ErrAmountNotCanonical},
+		{"1e3", 0, Amount{}, ErrAmountNotCanonical},
+		{"1.5", 0, Amount{}, ErrAmountNotCanonical},
+		{"1.50", 2, Amount{}, ErrAmountNotCanonical},
+		{"1.005", 2, Amount{}, ErrAmountNotCanonical},
+		{".5", 2, Amount{}, ErrAmountNotCanonical},
+		{"1.", 2, Amount{}, ErrAmountNotCanonical},
+	}
+	for _, tt := range tests {
+		got, err := ParseAmount(tt.s, tt.decimals)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("ParseAmount(%q, %d) = %v, %v, want %v, %v", tt.s, tt.decimals, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestParsePositiveAmount(t *testing.T) {
+	for _, s := range []string{"0", "0.0"} {
+		if _, err := ParsePositiveAmount(s, 2); err == nil {
+			t.Errorf("ParsePositiveAmount(%q) accepts zero", s)
+		}
+	}
+	if _, err := ParsePositiveAmount("0", 0); !errors.Is(err, ErrAmountZero) {
+		t.Errorf("ParsePositiveAmount(\"0\") = %v, want %v", err, ErrAmountZero)
+	}
+	if got, err := ParsePositiveAmount("0.01", 2); err != nil || got != NewAmount(1) {
+		t.Errorf("ParsePositiveAmount(\"0.01\") = %v, %v, want 1", got, err)
+	}
+}
+
+func TestAmountFormat(t *testing.T) {
+	tests := []struct {
+		amount   Amount
+		decimals uint8
+		want     string
+	}{
+		{Amount{}, 0, "0"},
+		{Amount{}, 2, "0"},
+		{NewAmount(150), 0, "150"},
+		{NewAmount(150), 2, "1.5"},
+		{NewAmount(100), 2, "1"},
+		{NewAmount(5), 2, "0.05"},
+		{NewAmount(5), 3, "0.005"},
+		{maxAmount, 0, "340282366920938463463374607431768211455"},
+		{maxAmount, 38, "3.40282366920938463463374607431768211455"},
+	}
+	for _, tt := range tests {
+		got := tt.amount.Format(tt.decimals)
+		if got != tt.want {
+			t.Errorf("%v.Format(%d) = %q, want %q", tt.amount, tt.decimals, got, tt.want)
+		}
+		// The canonical form parses back to the same amount
+		if parsed, err := ParseAmount(got, tt.decimals); err != nil || parsed != tt.amount {
+			t.Errorf("ParseAmount(%q, %d) = %v, %v, want %v", got, tt.decimals, parsed, err, tt.amount)
+		}
+	}
+}
+
+func TestAmountAddSub(t *testing.T) {
+	if got, err := (Amount{lo: math.MaxUint64}).Add(NewAmount(1)); err != nil || got != (Amount{hi: 1}) {
+		t.Errorf("2^64 - 1 + 1 = %v, %v, want 2^64", got, err)
+	}
+	if got, err := maxAmount.Add(Amount{}); err != nil || got != maxAmount {
+		t.Errorf("2^128 - 1 + 0 = %v, %v", got, err)
+	}
+	if _, err := maxAmount.Add(NewAmount(1)); !errors.Is(err, ErrAmountOverflow) {
+		t.Errorf("2^128 - 1 + 1: %v, want %v", err, ErrAmountOverflow)
+	}
+	if _, err := maxAmount.Add(maxAmount); !errors.Is(err, ErrAmountOverflow) {
+		t.Errorf("(2^128 - 1) * 2: %v, want %v", err, ErrAmountOverflow)
+	}
+
+	if got, err := (Amount{hi: 1}).Sub(NewAmount(1)); err != nil || got != (Amount{lo: math.MaxUint64}) {
+		t.Errorf("2^64 - 1 = %v, %v, want 2^64 - 1", got, err)
+	}
+	if got, err := maxAmount.Sub(maxAmount); err != nil || !got.IsZero() {
+		t.Errorf("(2^128 - 1) - (2^128 - 1) = %v, %v, want 0", got, err)
+	}
+	if _, err := (Amount{}).Sub(NewAmount(1)); !errors.Is(err, ErrAmountUnderflow) {
+		t.Errorf("0 - 1: %v, want %v", err, ErrAmountUnderflow)
+	}
+	if _, err := (Amount{hi: 1}).Sub(maxAmount); !errors.Is(err, ErrAmountUnderflow) {
+		t.Errorf("2^64 - (2^128 - 1): %v, want %v", err, ErrAmountUnderflow)
+	}
+}
+
+func TestAmountJSON(t *testing.T) {
+	data, err := json.Marshal(maxAmount)
+	if err != nil || string(data) != `"340282366920938463463374607431768211455"` {
+		t.Fatalf("Marshal(2^128 - 1) = %s, %v", data, err)
+	}
+	var got Amount
+	if err := json.Unmarshal(data, &got); err != nil || got != maxAmount {
+		t.Fatalf("Unmarshal(%s) = %v, %v", data, got, err)
+	}
+	for _, data := range []string{`50`, `"050"`, `"1.5"`, `"-1"`} {
+		if err := json.Unmarshal([]byte(data), &got); err == nil {
+			t.Errorf("Unmarshal(%s) accepts a non-canonical amount", data)
+		}
+	}
+}
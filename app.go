@@ -2,139 +2,568 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
-	"strconv"
+	"strings"
+	"time"
 
+	"test/apperrors"
 	"test/db"
 
 	abcitypes "github.com/cometbft/cometbft/abci/types"
+	cmtproto "github.com/cometbft/cometbft/api/cometbft/types/v1"
+	cmttypes "github.com/cometbft/cometbft/types"
 )
 
 type KVStoreApplication struct {
 	db           db.DB
 	onGoingBlock db.Transaction
+
+	// last block written to the database
+	height  int64
+	appHash []byte
+
+	// maintenance runs the backend's storage maintenance, nil if disabled
+	maintenance *db.Scheduler
+
+	// invariantInterval overrides the invariant_interval param when it isn't
+	// negative, 0 disables the invariant checks
+	invariantInterval int64
+
+	// stateHash keeps the app hash up to date from blockWrites, the state
+	// entries written by the ongoing block
+	stateHash   *stateHash
+	blockWrites map[string][]byte
+
+	// maxBlockBytes and maxBlockGas are the max_bytes and max_gas consensus
+	// params, -1 for their defaults
+	maxBlockBytes int64
+	maxBlockGas   int64
+
+	// oracleFeed is the file or URL of the prices this node's validator
+	// attaches to its votes, none if empty
+	oracleFeed string
+	// chainID is the id of the chain, covered by vote extension signatures
+	chainID string
+
+	// validatorUpdates are the changes of the validator set made by the
+	// ongoing block, by address
+	validatorUpdates map[string]abcitypes.ValidatorUpdate
+	// keyRotations are the new public keys of the accounts that rotated their
+	// key in the ongoing block, applied once its transactions have run
+	keyRotations map[string]string
+
+	// undo journals the in-memory changes of the running transaction, nil
+	// outside of one
+	undo []func()
+	// gas meters the running transaction, nil outside of one
+	gas *GasMeter
 }
 
 var _ abcitypes.Application = (*KVStoreApplication)(nil)
 
-func NewKVStoreApplication(database db.DB) *KVStoreApplication {
-	return &KVStoreApplication{db: database}
+func NewKVStoreApplication(database db.DB) (*KVStoreApplication, error) {
+	app := &KVStoreApplication{
+		db:                database,
+		invariantInterval: -1,
+		maxBlockBytes:     -1,
+		maxBlockGas:       -1,
+		validatorUpdates:  map[string]abcitypes.ValidatorUpdate{},
+		keyRotations:      map[string]string{},
+	}
+	if err := app.loadState(); err != nil {
+		return nil, fmt.Errorf("loading state: %w", err)
+	}
+	app.stateHash = newStateHash(stateEntries())
+	return app, nil
 }
+
 func (app *KVStoreApplication) Info(_ context.Context, info *abcitypes.InfoRequest) (*abcitypes.InfoResponse, error) {
-	return &abcitypes.InfoResponse{}, nil
+	return &abcitypes.InfoResponse{
+		LastBlockHeight:  app.height,
+		LastBlockAppHash: app.appHash,
+	}, nil
 }
 
 func (app *KVStoreApplication) Query(_ context.Context, req *abcitypes.QueryRequest) (*abcitypes.QueryResponse, error) {
-	resp := abcitypes.QueryResponse{Key: req.Data}
+	switch {
+	case req.Path == "/storage":
+		return app.queryStorage(), nil
+	case req.Path == "/errors":
+		return queryErrors()
+	case req.Path == "/validators":
+		return queryValidators()
+	case strings.HasPrefix(req.Path, "/delegations/"):
+		return queryDelegations(strings.TrimPrefix(req.Path, "/delegations/"))
+	case strings.HasPrefix(req.Path, "/unbonding/"):
+		return queryUnbondings(strings.TrimPrefix(req.Path, "/unbonding/"))
+	case req.Path == "/prices":
+		return app.queryPrices()
+	case strings.HasPrefix(req.Path, "/price/"):
+		return app.queryKey([]byte("price/" + strings.TrimPrefix(req.Path, "/price/")))
+	case req.Path == "/supply":
+		return app.querySupplies()
+	case strings.HasPrefix(req.Path, "/supply/"):
+		denom := strings.TrimPrefix(req.Path, "/supply/")
+		return app.queryDenom(denom, []byte(supplyStoreKey(denom)))
+	case strings.HasPrefix(req.Path, "/balance/"):
+		denom := strings.TrimPrefix(req.Path, "/balance/")
+		return app.queryDenom(denom, []byte(balanceKey(denom, string(req.Data))))
+	}
+
+	return app.queryKey(req.Data)
+}
 
-	value, err := app.db.Get(req.Data)
+// queryKey returns the value stored under key. Database errors are returned
+// rather than reported in the response.
+func (app *KVStoreApplication) queryKey(key []byte) (*abcitypes.QueryResponse, error) {
+	resp := abcitypes.QueryResponse{Key: key}
+
+	value, err := app.db.Get(key)
 	if err != nil {
 		if errors.Is(err, db.ErrKeyNotFound) {
 			resp.Log = "key does not exist"
 			return &resp, nil
 		}
-		log.Panicf("Error reading database, unable to execute query: %v", err)
+		return nil, fmt.Errorf("reading %q: %w", key, err)
 	}
 
 	resp.Log = "exists"
 	resp.Value = value
 	return &resp, nil
 }
+
+// queryDenom returns the value stored under key if denom is a known asset
+func (app *KVStoreApplication) queryDenom(denom string, key []byte) (*abcitypes.QueryResponse, error) {
+	if _, ok := denomDecimals(denom); !ok {
+		return queryError(apperrors.ErrUnknownDenom.Wrapf("%q", denom)), nil
+	}
+	return app.queryKey(key)
+}
+
+// queryError returns a response reporting err
+func queryError(err error) *abcitypes.QueryResponse {
+	codespace, code, msg := apperrors.ABCIInfo(err)
+	return &abcitypes.QueryResponse{Codespace: codespace, Code: code, Log: msg}
+}
+
+// queryErrors lists the registered error codes
+func queryErrors() (*abcitypes.QueryResponse, error) {
+	value, err := json.Marshal(apperrors.Entries())
+	if err != nil {
+		return nil, fmt.Errorf("encoding errors: %w", err)
+	}
+	return &abcitypes.QueryResponse{Log: "exists", Value: value}, nil
+}
+
+// querySupplies returns the supply counters of every asset by denom
+func (app *KVStoreApplication) querySupplies() (*abcitypes.QueryResponse, error) {
+	supplies := map[string]json.RawMessage{}
+	err := app.db.Iterate(supplyKey, func(key, value []byte) error {
+		if string(key) == string(supplyKey) {
+			supplies[nativeDenom()] = value
+		} else if denom, ok := strings.CutPrefix(string(key), "supply/"); ok {
+			supplies[denom] = value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading supplies: %w", err)
+	}
+	value, err := json.Marshal(supplies)
+	if err != nil {
+		return nil, fmt.Errorf("encoding supplies: %w", err)
+	}
+	return &abcitypes.QueryResponse{Log: "exists", Value: value}, nil
+}
+
+// queryStorage reports the backend's disk usage and its last maintenance run
+func (app *KVStoreApplication) queryStorage() *abcitypes.QueryResponse {
+	maintainer, ok := app.db.(db.Maintainer)
+	if !ok {
+		return queryError(errors.New("storage stats are not supported by this database"))
+	}
+	usage, err := maintainer.DiskUsage()
+	if err != nil {
+		return queryError(fmt.Errorf("reading disk usage: %w", err))
+	}
+	value, err := json.Marshal(struct {
+		Usage       db.DiskUsage        `json:"usage"`
+		Maintenance db.MaintenanceStats `json:"maintenance"`
+	}{usage, app.maintenance.Stats()})
+	if err != nil {
+		return queryError(fmt.Errorf("encoding storage stats: %w", err))
+	}
+	return &abcitypes.QueryResponse{Log: "exists", Value: value}
+}
+
 func (app *KVStoreApplication) CheckTx(_ context.Context, check *abcitypes.CheckTxRequest) (*abcitypes.CheckTxResponse, error) {
-	code := app.isValid(check.Tx)
-	return &abcitypes.CheckTxResponse{Code: code}, nil
+	result := app.isValid(check.Tx, -1)
+	codespace, code, msg := apperrors.ABCIInfo(result.err)
+	gasWanted, gasUsed := result.gasInfo()
+	return &abcitypes.CheckTxResponse{
+		Codespace: codespace,
+		Code:      code,
+		Log:       msg,
+		GasWanted: gasWanted,
+		GasUsed:   gasUsed,
+	}, nil
 }
 
 func (app *KVStoreApplication) InitChain(_ context.Context, chain *abcitypes.InitChainRequest) (*abcitypes.InitChainResponse, error) {
-	return &abcitypes.InitChainResponse{}, nil
+	genesis := defaultGenesisState()
+	if len(chain.AppStateBytes) > 0 {
+		if err := json.Unmarshal(chain.AppStateBytes, &genesis); err != nil {
+			return nil, fmt.Errorf("decoding app_state: %w", err)
+		}
+	}
+
+	var err error
+	app.onGoingBlock, err = app.db.BeginTx()
+	if err != nil {
+		return nil, fmt.Errorf("beginning genesis transaction: %w", err)
+	}
+	// Store the genesis state so that the database holds the whole ledger
+	if err := app.importGenesis(genesis); err != nil {
+		app.onGoingBlock.Rollback()
+		return nil, fmt.Errorf("importing app_state: %w", err)
+	}
+	maxBytes, maxGas := int64(-1), int64(-1)
+	if chain.ConsensusParams != nil && chain.ConsensusParams.Block != nil {
+		maxBytes, maxGas = chain.ConsensusParams.Block.MaxBytes, chain.ConsensusParams.Block.MaxGas
+	}
+	if err := app.setBlockLimits(maxBytes, maxGas); err != nil {
+		app.onGoingBlock.Rollback()
+		return nil, err
+	}
+	if chain.ConsensusParams != nil {
+		if err := app.setConsensusParams(cmttypes.DefaultConsensusParams().Update(chain.ConsensusParams)); err != nil {
+			app.onGoingBlock.Rollback()
+			return nil, err
+		}
+	}
+	if err := app.setChainID(chain.ChainId); err != nil {
+		app.onGoingBlock.Rollback()
+		return nil, err
+	}
+	// The validators of the app_state, if any, replace those of the genesis file
+	var validators []abcitypes.ValidatorUpdate
+	if len(genesis.Validators) == 0 {
+		err = app.initValidators(chain.Validators)
+	} else {
+		validators, err = genesisValidatorUpdates(chain.Validators)
+	}
+	if err != nil {
+		app.onGoingBlock.Rollback()
+		return nil, fmt.Errorf("importing validators: %w", err)
+	}
+	initialHeight := chain.InitialHeight
+	if initialHeight == 0 {
+		initialHeight = 1
+	}
+	if err := app.initSigningSets(initialHeight); err != nil {
+		app.onGoingBlock.Rollback()
+		return nil, err
+	}
+	if err := app.onGoingBlock.Commit(); err != nil {
+		return nil, fmt.Errorf("committing genesis state: %w", err)
+	}
+	app.stateHash = newStateHash(stateEntries())
+	return &abcitypes.InitChainResponse{AppHash: app.stateHash.sum(), Validators: validators}, nil
 }
 
 func (app *KVStoreApplication) PrepareProposal(_ context.Context, proposal *abcitypes.PrepareProposalRequest) (*abcitypes.PrepareProposalResponse, error) {
-	return &abcitypes.PrepareProposalResponse{Txs: proposal.Txs}, nil
+	txs, err := app.prepareTxs(proposal)
+	if err != nil {
+		return nil, err
+	}
+	return &abcitypes.PrepareProposalResponse{Txs: txs}, nil
 }
+
 func (app *KVStoreApplication) ProcessProposal(_ context.Context, proposal *abcitypes.ProcessProposalRequest) (*abcitypes.ProcessProposalResponse, error) {
+	if err := app.checkProposal(proposal); err != nil {
+		log.Printf("Rejecting proposal at height %d from %X: %v", proposal.Height, proposal.ProposerAddress, err)
+		return &abcitypes.ProcessProposalResponse{Status: abcitypes.PROCESS_PROPOSAL_STATUS_REJECT}, nil
+	}
 	return &abcitypes.ProcessProposalResponse{Status: abcitypes.PROCESS_PROPOSAL_STATUS_ACCEPT}, nil
 }
 
 func (app *KVStoreApplication) FinalizeBlock(_ context.Context, req *abcitypes.FinalizeBlockRequest) (*abcitypes.FinalizeBlockResponse, error) {
 	var txs = make([]*abcitypes.ExecTxResult, len(req.Txs))
 
-	var err error
-	app.onGoingBlock, err = app.db.BeginTx()
+	tx, err := app.db.BeginTx()
 	if err != nil {
-		log.Panicf("Error beginning transaction: %v", err)
+		return nil, fmt.Errorf("beginning block transaction: %w", err)
 	}
+	app.blockWrites = map[string][]byte{}
+	app.onGoingBlock = newBlockTx(tx, app.blockWrites)
+
+	// Only storage failures are returned, which halts the node before the
+	// block is committed. Invalid transactions fail on their own.
+	events, err := app.beginBlock(req.Height, req.Time, req.Misbehavior)
+	if err != nil {
+		app.onGoingBlock.Rollback()
+		return nil, err
+	}
+	collector := feeRecipient(req.ProposerAddress)
 
 	for i, tx := range req.Txs {
-		if code := app.isValid(tx); code != 0 {
-			fmt.Printf("Error: invalid transaction index %v", i)
-			txs[i] = &abcitypes.ExecTxResult{Code: code}
+		if i == 0 && isOracleTx(tx) {
+			txs[i], err = app.executeOracleTx(tx, req.Height)
 		} else {
-			var transaction Transaction
-			if err := transaction.FromBytes(tx); err != nil {
-				log.Panicf("Error parsing tx bytes, unable to parse tx: %v", err)
-			}
-			for _, transfer := range transaction.Transfers {
-				src, dst, amount := transfer.Sender, transfer.Dest, transfer.Amount
-				fmt.Printf("Adding key %s with value %s", src, dst)
-
-				srcValue, dstValue := balanceMap[src], balanceMap[dst]
-
-				amountValue, err := strconv.ParseUint(string(amount), 10, 64)
-				if err != nil {
-					log.Panicf("Error parsing amount, unable to execute tx: %v", err)
-				}
-
-				srcValue -= amountValue
-				dstValue += amountValue
-
-				if err := app.onGoingBlock.Set([]byte(src), []byte(amount)); err != nil {
-					log.Panicf("Error writing source key to database, unable to execute tx: %v", err)
-				}
-				if err := app.onGoingBlock.Set([]byte(dst), []byte(amount)); err != nil {
-					log.Panicf("Error writing destination key to database, unable to execute tx: %v", err)
-				}
-				balanceMap[string(src)] = srcValue
-				balanceMap[string(dst)] = dstValue
-				fmt.Printf("Successfully added key %s with value %s", src, dst)
-
-				// Add an event for the transaction execution.
-				// Multiple events can be emitted for a transaction, but we are adding only one event
-				if txs[i] != nil {
-					txs[i].Events = append(txs[i].Events, abcitypes.Event{
-						Type: "app",
-						Attributes: []abcitypes.EventAttribute{
-							{Key: "src", Value: string(src), Index: true},
-							{Key: "dst", Value: string(dst), Index: true},
-							{Key: "amount", Value: string(amount), Index: true},
-						},
-					})
-				} else {
-					txs[i] = &abcitypes.ExecTxResult{
-						Code: 0,
-						Events: []abcitypes.Event{
-							{
-								Type: "app",
-								Attributes: []abcitypes.EventAttribute{
-									{Key: "src", Value: string(src), Index: true},
-									{Key: "dst", Value: string(dst), Index: true},
-									{Key: "amount", Value: string(amount), Index: true},
-								},
-							},
-						},
-					}
-				}
-			}
+			txs[i], err = app.executeTx(tx, collector, req.Time, -1)
+		}
+		if err != nil {
+			app.onGoingBlock.Rollback()
+			return nil, fmt.Errorf("executing transaction %d at height %d: %w", i, req.Height, err)
+		}
+		if txs[i].Code != 0 {
+			fmt.Printf("Error: invalid transaction index %v", i)
+		}
+	}
+
+	endEvents, validatorUpdates, paramUpdates, err := app.endBlock(req.Height, req.ProposerAddress, req.DecidedLastCommit)
+	if err != nil {
+		app.onGoingBlock.Rollback()
+		return nil, err
+	}
+	events = append(events, endEvents...)
+
+	if err := app.commitMeta(req.Height); err != nil {
+		app.onGoingBlock.Rollback()
+		return nil, err
+	}
+
+	if interval := app.invariantSweepInterval(); interval > 0 && req.Height%interval == 0 {
+		if err := app.checkState(); err != nil {
+			// Returning an error halts the node before the broken state is committed
+			app.onGoingBlock.Rollback()
+			log.Printf("CRITICAL: invariant broken at height %d, halting: %v", req.Height, err)
+			return nil, fmt.Errorf("invariant broken at height %d: %w", req.Height, err)
 		}
 	}
 
 	return &abcitypes.FinalizeBlockResponse{
-		TxResults: txs,
+		TxResults:             txs,
+		ValidatorUpdates:      validatorUpdates,
+		ConsensusParamUpdates: paramUpdates,
+		Events:                events,
+		AppHash:               app.appHash,
+	}, nil
+}
+
+// beginBlock runs the steps of a block before its transactions
+func (app *KVStoreApplication) beginBlock(height int64, blockTime time.Time, misbehavior []abcitypes.Misbehavior) ([]abcitypes.Event, error) {
+	app.validatorUpdates = map[string]abcitypes.ValidatorUpdate{}
+	app.keyRotations = map[string]string{}
+	consensusUpdate = nil
+
+	events, err := app.expirePendingTransfers(blockTime)
+	if err != nil {
+		return nil, fmt.Errorf("expiring pending transfers at height %d: %w", height, err)
+	}
+	unbonded, err := app.completeUnbondings(height)
+	if err != nil {
+		return nil, fmt.Errorf("completing unbondings at height %d: %w", height, err)
+	}
+	events = append(events, unbonded...)
+	slashed, err := app.processMisbehavior(misbehavior)
+	if err != nil {
+		return nil, fmt.Errorf("processing misbehavior at height %d: %w", height, err)
+	}
+	return append(events, slashed...), nil
+}
+
+// endBlock runs the steps of a block after its transactions and returns the
+// changes of the validator set and consensus params it makes
+func (app *KVStoreApplication) endBlock(height int64, proposer []byte, lastCommit abcitypes.CommitInfo) ([]abcitypes.Event, []abcitypes.ValidatorUpdate, *cmtproto.ConsensusParams, error) {
+	if err := app.applyKeyRotations(); err != nil {
+		return nil, nil, nil, fmt.Errorf("rotating keys at height %d: %w", height, err)
+	}
+	events, err := app.distributeRewards(proposer, lastCommit)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("distributing rewards at height %d: %w", height, err)
+	}
+	paramUpdates, err := app.applyConsensusUpdate()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("updating consensus params at height %d: %w", height, err)
+	}
+	validatorUpdates := app.blockValidatorUpdates()
+	if err := app.recordSigningSet(height, validatorUpdates); err != nil {
+		return nil, nil, nil, fmt.Errorf("recording validator set at height %d: %w", height, err)
+	}
+	return events, validatorUpdates, paramUpdates, nil
+}
+
+// executeTx runs a transaction if it is valid, crediting its fee to collector
+// and metering its gas within gasLeft, unless it is negative. A transaction
+// failing while it runs is reverted and reported in its result, only a failure
+// to write to the ongoing block is returned.
+func (app *KVStoreApplication) executeTx(tx []byte, collector string, blockTime time.Time, gasLeft int64) (*abcitypes.ExecTxResult, error) {
+	check := app.isValid(tx, gasLeft)
+	result := &abcitypes.ExecTxResult{}
+	if check.err != nil {
+		result.GasWanted, result.GasUsed = check.gasInfo()
+		result.Codespace, result.Code, result.Log = apperrors.ABCIInfo(check.err)
+		return result, nil
+	}
+
+	block := app.onGoingBlock
+	batch := newTxBatch(block, check.gas)
+	app.onGoingBlock, app.undo, app.gas = batch, []func(){}, check.gas
+	events, err := app.runTx(check.tx, collector, blockTime)
+	if err == nil {
+		err = check.gas.Err()
+	}
+	if err != nil {
+		app.revert()
+	}
+	app.onGoingBlock, app.undo, app.gas = block, nil, nil
+	result.GasWanted, result.GasUsed = check.gasInfo()
+	if err != nil {
+		result.Codespace, result.Code, result.Log = apperrors.ABCIInfo(err)
+		return result, nil
+	}
+
+	if err := batch.Commit(); err != nil {
+		return nil, err
+	}
+	result.Events = events
+	return result, nil
+}
+
+// runTx charges the fee of a valid transaction and runs its messages
+func (app *KVStoreApplication) runTx(transaction *Transaction, collector string, blockTime time.Time) ([]abcitypes.Event, error) {
+	var events []abcitypes.Event
+	if transaction.Fee != nil {
+		event, err := app.chargeFee(transaction.Fee, collector)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	for i, msg := range transaction.Msgs {
+		// Multiple events can be emitted for a transaction, one per message
+		var event abcitypes.Event
+		var err error
+		switch msg := msg.(type) {
+		case *Transfer:
+			event, err = app.executeTransfer(msg)
+		case *PendingTransfer:
+			event, err = app.executePendingTransfer(msg, blockTime)
+		case *PostPendingTransfer:
+			event, err = app.executePostPendingTransfer(msg)
+		case *VoidPendingTransfer:
+			event, err = app.executeVoidPendingTransfer(msg)
+		case *CreateAsset:
+			event, err = app.executeCreateAsset(msg)
+		case *Mint:
+			event, err = app.executeMint(msg)
+		case *Burn:
+			event, err = app.executeBurn(msg)
+		case *UpdateValidator:
+			event, err = app.executeUpdateValidator(msg)
+		case *Bond:
+			event, err = app.executeBond(msg)
+		case *Unbond:
+			event, err = app.executeUnbond(msg)
+		case *UpdateConsensusParams:
+			event, err = app.executeUpdateConsensusParams(msg)
+		case *RotateKey:
+			event, err = app.executeRotateKey(msg)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %w", i, err)
+		}
+		events = append(events, event)
+		if err := app.setNonce(msg.Signer(), nonceMap[msg.Signer()]+1); err != nil {
+			return nil, err
+		}
+		if msg, ok := msg.(uniqueMsg); ok {
+			if err := app.setMsgId(msgIdKey(msg), app.executingHeight()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return events, nil
+}
+
+func (app *KVStoreApplication) executeTransfer(transfer *Transfer) (abcitypes.Event, error) {
+	src, dst, amount, denom := transfer.Sender, transfer.Dest, transfer.Amount, transfer.denom()
+	fmt.Printf("Adding key %s with value %s", src, dst)
+
+	decimals, ok := denomDecimals(denom)
+	if !ok {
+		return abcitypes.Event{}, apperrors.ErrUnknownDenom.Wrapf("%q", denom)
+	}
+	amountValue, err := parseAmount(amount, decimals)
+	if err != nil {
+		return abcitypes.Event{}, err
+	}
+
+	if err := app.debit(denom, src, amountValue); err != nil {
+		return abcitypes.Event{}, err
+	}
+	if err := app.credit(denom, dst, amountValue); err != nil {
+		return abcitypes.Event{}, err
+	}
+	fmt.Printf("Successfully added key %s with value %s", src, dst)
+
+	// Add an event for the transfer execution.
+	return abcitypes.Event{
+		Type: "app",
+		Attributes: []abcitypes.EventAttribute{
+			{Key: "src", Value: src, Index: true},
+			{Key: "dst", Value: dst, Index: true},
+			{Key: "amount", Value: amount, Index: true},
+			{Key: "denom", Value: denom, Index: true},
+		},
 	}, nil
 }
 
+// setBalance updates the balance of an account in denom and writes it to the ongoing block.
+func (app *KVStoreApplication) setBalance(denom, account string, value Amount) error {
+	if balanceMap[denom] == nil {
+		balanceMap[denom] = map[string]Amount{}
+	}
+	journalEntry(app, balanceMap[denom], account)
+	balanceMap[denom][account] = value
+	if err := app.onGoingBlock.Set([]byte(balanceKey(denom, account)), []byte(value.String())); err != nil {
+		return fmt.Errorf("writing balance of %s in %s: %w", account, denom, err)
+	}
+	return nil
+}
+
+// debit takes amount of denom from the balance of account
+func (app *KVStoreApplication) debit(denom, account string, amount Amount) error {
+	balance, err := balanceOf(denom, account).Sub(amount)
+	if err != nil {
+		return apperrors.ErrInsufficientFunds.Wrapf("account %s has %s %s, needs %s", account, balanceOf(denom, account), denom, amount)
+	}
+	return app.setBalance(denom, account, balance)
+}
+
+// credit adds amount of denom to the balance of account
+func (app *KVStoreApplication) credit(denom, account string, amount Amount) error {
+	balance, err := balanceOf(denom, account).Add(amount)
+	if err != nil {
+		return apperrors.ErrSupplyOverflow.Wrapf("balance of account %s in %s", account, denom)
+	}
+	return app.setBalance(denom, account, balance)
+}
+
+// parseAmount parses an amount of a message that has already been checked by
+// isValid, reporting it as an invalid amount otherwise
+func parseAmount(s string, decimals uint8) (Amount, error) {
+	amount, err := ParseAmount(s, decimals)
+	if err != nil {
+		return Amount{}, apperrors.ErrInvalidAmount.Wrapf("%q: %v", s, err)
+	}
+	return amount, nil
+}
+
 func (app KVStoreApplication) Commit(_ context.Context, commit *abcitypes.CommitRequest) (*abcitypes.CommitResponse, error) {
 	return &abcitypes.CommitResponse{}, app.onGoingBlock.Commit()
 }
@@ -156,9 +585,15 @@ func (app *KVStoreApplication) ApplySnapshotChunk(_ context.Context, chunk *abci
 }
 
 func (app KVStoreApplication) ExtendVote(_ context.Context, extend *abcitypes.ExtendVoteRequest) (*abcitypes.ExtendVoteResponse, error) {
-	return &abcitypes.ExtendVoteResponse{}, nil
+	return &abcitypes.ExtendVoteResponse{VoteExtension: app.oracleVote(extend.Height)}, nil
 }
 
+// VerifyVoteExtension checks the format of the prices of another validator.
+// CometBFT has already verified that its key signed the extension.
 func (app *KVStoreApplication) VerifyVoteExtension(_ context.Context, verify *abcitypes.VerifyVoteExtensionRequest) (*abcitypes.VerifyVoteExtensionResponse, error) {
-	return &abcitypes.VerifyVoteExtensionResponse{}, nil
+	if _, err := parseOracleVote(verify.VoteExtension, verify.Height); err != nil {
+		log.Printf("Rejecting vote extension of %X at height %d: %v", verify.ValidatorAddress, verify.Height, err)
+		return &abcitypes.VerifyVoteExtensionResponse{Status: abcitypes.VERIFY_VOTE_EXTENSION_STATUS_REJECT}, nil
+	}
+	return &abcitypes.VerifyVoteExtensionResponse{Status: abcitypes.VERIFY_VOTE_EXTENSION_STATUS_ACCEPT}, nil
 }
@@ -0,0 +1,146 @@
+// Package apperrors holds the registry of the error codes the application
+// reports in CheckTx, FinalizeBlock and Query responses, so that clients can
+// decode a response's codespace and code into the error it stands for.
+package apperrors
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Error is a registered failure with a stable code. Errors are returned
+// wrapped with the details of each occurrence, which become the response's log.
+type Error struct {
+	codespace string
+	code      uint32
+	name      string
+	desc      string
+}
+
+func (e *Error) Error() string { return e.desc }
+
+func (e *Error) Codespace() string { return e.codespace }
+
+func (e *Error) Code() uint32 { return e.code }
+
+// Name is the identifier of the error, such as "insufficient_funds"
+func (e *Error) Name() string { return e.name }
+
+// Wrapf returns e with a description of the occurrence
+func (e *Error) Wrapf(format string, args ...any) error {
+	return fmt.Errorf("%s: %w", fmt.Sprintf(format, args...), e)
+}
+
+type key struct {
+	codespace string
+	code      uint32
+}
+
+var (
+	mu       sync.RWMutex
+	registry = map[key]*Error{}
+)
+
+// Register adds an error to the registry. Code 0 means success and can't be
+// registered, nor can a code be registered twice in a codespace.
+func Register(codespace string, code uint32, name, desc string) *Error {
+	if code == 0 {
+		panic(fmt.Sprintf("apperrors: code 0 is reserved for success in codespace %s", codespace))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	k := key{codespace, code}
+	if e, ok := registry[k]; ok {
+		panic(fmt.Sprintf("apperrors: code %d of codespace %s is already registered as %s", code, codespace, e.name))
+	}
+	e := &Error{codespace: codespace, code: code, name: name, desc: desc}
+	registry[k] = e
+	return e
+}
+
+// Lookup returns the error registered under codespace and code
+func Lookup(codespace string, code uint32) (*Error, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	e, ok := registry[key{codespace, code}]
+	return e, ok
+}
+
+// Entry describes a registered error, as listed by the /errors query
+type Entry struct {
+	Codespace   string `json:"codespace"`
+	Code        uint32 `json:"code"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// Entries returns the registered errors ordered by codespace and code
+func Entries() []Entry {
+	mu.RLock()
+	defer mu.RUnlock()
+	entries := make([]Entry, 0, len(registry))
+	for _, e := range registry {
+		entries = append(entries, Entry{Codespace: e.codespace, Code: e.code, Name: e.name, Description: e.desc})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Codespace != entries[j].Codespace {
+			return entries[i].Codespace < entries[j].Codespace
+		}
+		return entries[i].Code < entries[j].Code
+	})
+	return entries
+}
+
+// ABCIInfo returns the codespace, code and log reporting err, nothing for a nil
+// error. Errors that don't wrap an *Error are reported as ErrInternal.
+func ABCIInfo(err error) (codespace string, code uint32, log string) {
+	if err == nil {
+		return "", 0, ""
+	}
+	var e *Error
+	if !errors.As(err, &e) {
+		e = ErrInternal
+	}
+	return e.codespace, e.code, err.Error()
+}
+
+// ResponseError is the error decoded from a response. It unwraps to the
+// registered *Error, so clients can match it with errors.Is.
+type ResponseError struct {
+	Codespace string
+	Code      uint32
+	Log       string
+
+	registered *Error
+}
+
+func (e *ResponseError) Error() string {
+	if e.Log != "" {
+		return e.Log
+	}
+	if e.registered != nil {
+		return e.registered.desc
+	}
+	return fmt.Sprintf("error code %d in codespace %q", e.Code, e.Codespace)
+}
+
+// Unwrap returns the registered error, nil if the code is unknown
+func (e *ResponseError) Unwrap() error {
+	if e.registered == nil {
+		return nil
+	}
+	return e.registered
+}
+
+// FromABCI decodes the codespace, code and log of a response into an error,
+// nil for code 0. Codes that aren't registered, for instance those of a newer
+// application version, still decode into a *ResponseError.
+func FromABCI(codespace string, code uint32, log string) error {
+	if code == 0 {
+		return nil
+	}
+	registered, _ := Lookup(codespace, code)
+	return &ResponseError{Codespace: codespace, Code: code, Log: log, registered: registered}
+}
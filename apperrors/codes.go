@@ -0,0 +1,38 @@
+package apperrors
+
+// Codespace qualifies the codes of the errors returned by the application
+const Codespace = "kvstore"
+
+// The codes are part of the application's interface and never change meaning.
+var (
+	// ErrInternal is reported for errors that aren't an *Error, which
+	// indicate a bug rather than an invalid transaction
+	ErrInternal               = Register(Codespace, 1, "internal", "internal error")
+	ErrTxDecode               = Register(Codespace, 2, "tx_decode", "malformed transaction")
+	ErrUnknownAccount         = Register(Codespace, 3, "unknown_account", "unknown signer")
+	ErrUnknownRecipient       = Register(Codespace, 4, "unknown_recipient", "unknown recipient")
+	ErrInsufficientFunds      = Register(Codespace, 5, "insufficient_funds", "insufficient funds")
+	ErrInvalidPubKey          = Register(Codespace, 6, "invalid_pub_key", "invalid public key")
+	ErrBadSignature           = Register(Codespace, 7, "bad_signature", "signature verification failed")
+	ErrInvalidAmount          = Register(Codespace, 8, "invalid_amount", "invalid amount")
+	ErrInvalidSignature       = Register(Codespace, 9, "invalid_signature", "malformed signature")
+	ErrInvalidPendingTransfer = Register(Codespace, 10, "invalid_pending_transfer", "invalid pending transfer id or timeout")
+	ErrPendingTransferExists  = Register(Codespace, 11, "pending_transfer_exists", "pending transfer id already used")
+	ErrPendingTransferClosed  = Register(Codespace, 12, "pending_transfer_closed", "pending transfer not found or already settled")
+	ErrNotPendingRecipient    = Register(Codespace, 13, "not_pending_recipient", "signer is not the recipient of the pending transfer")
+	ErrPostExceedsPending     = Register(Codespace, 14, "post_exceeds_pending", "posted amount exceeds the pending amount")
+	ErrUnknownDenom           = Register(Codespace, 15, "unknown_denom", "unknown denom")
+	ErrInvalidDenom           = Register(Codespace, 16, "invalid_denom", "invalid or existing denom")
+	ErrInvalidDecimals        = Register(Codespace, 17, "invalid_decimals", "invalid decimals")
+	ErrNotIssuer              = Register(Codespace, 18, "not_issuer", "signer is not the issuer of the asset")
+	ErrSupplyOverflow         = Register(Codespace, 19, "supply_overflow", "supply overflow")
+	ErrInsufficientFee        = Register(Codespace, 20, "insufficient_fee", "fee below the minimum")
+	ErrOutOfGas               = Register(Codespace, 21, "out_of_gas", "out of gas")
+	ErrInvalidGasLimit        = Register(Codespace, 22, "invalid_gas_limit", "invalid gas limit")
+	ErrUnauthorized           = Register(Codespace, 23, "unauthorized", "unauthorized signer")
+	ErrInvalidValidator       = Register(Codespace, 24, "invalid_validator", "invalid validator update")
+	ErrInsufficientStake      = Register(Codespace, 25, "insufficient_stake", "insufficient bonded stake")
+	ErrInvalidConsensusParams = Register(Codespace, 26, "invalid_consensus_params", "invalid consensus params update")
+	ErrDuplicateKeyRotation   = Register(Codespace, 27, "duplicate_key_rotation", "key already rotated in this block")
+	ErrMsgIdUsed              = Register(Codespace, 28, "msg_id_used", "message id already used")
+)
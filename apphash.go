@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/fnv"
+	"strings"
+
+	"test/db"
+)
+
+// stateHashBuckets is the number of buckets the state entries are hashed in
+const stateHashBuckets = 1024
+
+// stateHash is the app hash of the state, kept up to date from the entries
+// each block writes. Entries are hashed in buckets chosen by their key and the
+// app hash is the hash of the bucket hashes, so a block only rehashes the
+// buckets it writes to.
+type stateHash struct {
+	// entries holds the hash of the value of each entry by key, by bucket
+	entries [stateHashBuckets]map[string][sha256.Size]byte
+	buckets [stateHashBuckets][sha256.Size]byte
+}
+
+// newStateHash hashes every state entry
+func newStateHash(entries map[string][]byte) *stateHash {
+	h := &stateHash{}
+	for i := range h.entries {
+		h.entries[i] = map[string][sha256.Size]byte{}
+	}
+	h.update(entries)
+	for i := range h.buckets {
+		h.buckets[i] = h.hashBucket(i)
+	}
+	return h
+}
+
+// update applies the entries written by a block, nil for deleted entries, and
+// rehashes their buckets
+func (h *stateHash) update(writes map[string][]byte) {
+	changed := map[int]bool{}
+	for key, value := range writes {
+		bucket := stateHashBucket(key)
+		if value == nil {
+			delete(h.entries[bucket], key)
+		} else {
+			h.entries[bucket][key] = sha256.Sum256(value)
+		}
+		changed[bucket] = true
+	}
+	for bucket := range changed {
+		h.buckets[bucket] = h.hashBucket(bucket)
+	}
+}
+
+// hashBucket hashes the entries of a bucket in key order
+func (h *stateHash) hashBucket(bucket int) [sha256.Size]byte {
+	sum := sha256.New()
+	var length [binary.MaxVarintLen64]byte
+	for _, key := range sortedKeys(h.entries[bucket]) {
+		sum.Write(length[:binary.PutUvarint(length[:], uint64(len(key)))])
+		sum.Write([]byte(key))
+		value := h.entries[bucket][key]
+		sum.Write(value[:])
+	}
+	return [sha256.Size]byte(sum.Sum(nil))
+}
+
+// sum returns the app hash
+func (h *stateHash) sum() []byte {
+	sum := sha256.New()
+	for _, bucket := range h.buckets {
+		sum.Write(bucket[:])
+	}
+	return sum.Sum(nil)
+}
+
+func stateHashBucket(key string) int {
+	f := fnv.New32a()
+	f.Write([]byte(key))
+	return int(f.Sum32() % stateHashBuckets)
+}
+
+// blockTx is the transaction of a block, recording the state entries it
+// writes for the app hash. Keys under meta/ are not part of the state.
+type blockTx struct {
+	db.Transaction
+	// writes holds the value of each entry written, nil for deleted entries
+	writes map[string][]byte
+}
+
+// ledgerBlockTx is a blockTx for backends with native pending transfers
+type ledgerBlockTx struct {
+	*blockTx
+}
+
+var _ db.PendingTransfers = ledgerBlockTx{}
+
+// newBlockTx returns a transaction recording the entries tx writes in writes,
+// which is a db.PendingTransfers if tx is
+func newBlockTx(tx db.Transaction, writes map[string][]byte) db.Transaction {
+	block := &blockTx{Transaction: tx, writes: writes}
+	if _, ok := tx.(db.PendingTransfers); ok {
+		return ledgerBlockTx{block}
+	}
+	return block
+}
+
+func (t *blockTx) Set(key []byte, value []byte) error {
+	if !strings.HasPrefix(string(key), "meta/") {
+		t.writes[string(key)] = value
+	}
+	return t.Transaction.Set(key, value)
+}
+
+func (t *blockTx) Delete(key []byte) error {
+	if !strings.HasPrefix(string(key), "meta/") {
+		t.writes[string(key)] = nil
+	}
+	return t.Transaction.Delete(key)
+}
+
+func (t ledgerBlockTx) CreatePending(id, debit, credit []byte, amount db.Uint128, timeout uint32) error {
+	return t.Transaction.(db.PendingTransfers).CreatePending(id, debit, credit, amount, timeout)
+}
+
+func (t ledgerBlockTx) PostPending(id []byte, amount db.Uint128) error {
+	return t.Transaction.(db.PendingTransfers).PostPending(id, amount)
+}
+
+func (t ledgerBlockTx) VoidPending(id []byte) error {
+	return t.Transaction.(db.PendingTransfers).VoidPending(id)
+}
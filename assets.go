@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"test/apperrors"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+// defaultDenom names the native asset when the params don't
+const defaultDenom = "token"
+
+// denomPattern restricts denominations to characters that can't be confused
+// with the tx and key separators
+var denomPattern = regexp.MustCompile(`^[a-z][a-z0-9]{2,31}$`)
+
+// Asset is a denomination accounts can hold balances in, besides the native
+// asset described by the params
+type Asset struct {
+	// Decimals is the number of fractional digits of amounts of the asset
+	Decimals uint8 `json:"decimals"`
+	// Issuer is the only account allowed to mint and burn the asset, none if empty
+	Issuer string `json:"issuer,omitempty"`
+}
+
+// CreateAsset registers a new asset issued by Issuer, with no supply.
+type CreateAsset struct {
+	Denom     string `json:"denom"`
+	Issuer    string `json:"issuer"`
+	Decimals  string `json:"decimals"`
+	Signature string `json:"signature"`
+}
+
+// Mint creates Amount of an asset on Dest's balance. It must be signed by the
+// asset's issuer, who can use each id once.
+type Mint struct {
+	Id        string `json:"id"`
+	Denom     string `json:"denom"`
+	Dest      string `json:"dest"`
+	Amount    string `json:"amount"`
+	Issuer    string `json:"issuer"`
+	Signature string `json:"signature"`
+}
+
+// Burn destroys Amount of an asset from Account's balance. It must be signed
+// by the asset's issuer, who can use each id once.
+type Burn struct {
+	Id        string `json:"id"`
+	Denom     string `json:"denom"`
+	Account   string `json:"account"`
+	Amount    string `json:"amount"`
+	Issuer    string `json:"issuer"`
+	Signature string `json:"signature"`
+}
+
+// assetMap holds the non-native assets by denomination
+var assetMap = map[string]*Asset{}
+
+// nativeDenom returns the denomination of the native asset. Its balances are
+// stored under the bare account id.
+func nativeDenom() string {
+	if params.Denom == "" {
+		return defaultDenom
+	}
+	return params.Denom
+}
+
+// denomDecimals returns the decimals of an asset and whether it exists
+func denomDecimals(denom string) (uint8, bool) {
+	if denom == nativeDenom() {
+		return params.Decimals, true
+	}
+	asset, ok := assetMap[denom]
+	if !ok {
+		return 0, false
+	}
+	return asset.Decimals, true
+}
+
+// balanceKey returns the database key of an account's balance in denom
+func balanceKey(denom, account string) string {
+	if denom == nativeDenom() {
+		return account
+	}
+	return "balance/" + denom + "/" + account
+}
+
+// balanceOf returns the balance of an account in denom
+func balanceOf(denom, account string) Amount {
+	return balanceMap[denom][account]
+}
+
+// setAsset registers an asset and writes it to the ongoing block
+func (app *KVStoreApplication) setAsset(denom string, asset *Asset) error {
+	journalEntry(app, assetMap, denom)
+	assetMap[denom] = asset
+	if err := app.onGoingBlock.Set([]byte("asset/"+denom), encodeAsset(asset)); err != nil {
+		return fmt.Errorf("writing asset %s: %w", denom, err)
+	}
+	return nil
+}
+
+func encodeAsset(asset *Asset) []byte {
+	value, err := json.Marshal(asset)
+	if err != nil {
+		log.Panicf("Error encoding asset: %v", err)
+	}
+	return value
+}
+
+// parseCreateAsset decodes asset=denom=issuer=decimals=signature.
+func parseCreateAsset(parts [][]byte) Msg {
+	if len(parts) != 5 {
+		return nil
+	}
+	return &CreateAsset{
+		Denom:     string(parts[1]),
+		Issuer:    string(parts[2]),
+		Decimals:  string(parts[3]),
+		Signature: string(parts[4]),
+	}
+}
+
+// parseMint decodes mint=id=denom=dest=amount=issuer=signature.
+func parseMint(parts [][]byte) Msg {
+	if len(parts) != 7 {
+		return nil
+	}
+	return &Mint{
+		Id:        string(parts[1]),
+		Denom:     string(parts[2]),
+		Dest:      string(parts[3]),
+		Amount:    string(parts[4]),
+		Issuer:    string(parts[5]),
+		Signature: string(parts[6]),
+	}
+}
+
+// parseBurn decodes burn=id=denom=account=amount=issuer=signature.
+func parseBurn(parts [][]byte) Msg {
+	if len(parts) != 7 {
+		return nil
+	}
+	return &Burn{
+		Id:        string(parts[1]),
+		Denom:     string(parts[2]),
+		Account:   string(parts[3]),
+		Amount:    string(parts[4]),
+		Issuer:    string(parts[5]),
+		Signature: string(parts[6]),
+	}
+}
+
+func (c *CreateAsset) Signer() string { return c.Issuer }
+
+func (c *CreateAsset) Sig() string { return c.Signature }
+
+func (c *CreateAsset) Challenge() []byte {
+	return []byte(strings.Join([]string{"asset", c.Denom, c.Issuer, c.Decimals}, "="))
+}
+
+func (m *Mint) Signer() string { return m.Issuer }
+
+func (m *Mint) Sig() string { return m.Signature }
+
+func (m *Mint) Challenge() []byte {
+	return []byte(strings.Join([]string{"mint", m.Id, m.Denom, m.Dest, m.Amount}, "="))
+}
+
+func (m *Mint) msgId() (string, string) { return "mint", m.Id }
+
+func (b *Burn) Signer() string { return b.Issuer }
+
+func (b *Burn) Sig() string { return b.Signature }
+
+func (b *Burn) Challenge() []byte {
+	return []byte(strings.Join([]string{"burn", b.Id, b.Denom, b.Account, b.Amount}, "="))
+}
+
+func (b *Burn) msgId() (string, string) { return "burn", b.Id }
+
+func isValidCreateAsset(c *CreateAsset, ctx *txContext) error {
+	if !denomPattern.MatchString(c.Denom) {
+		return apperrors.ErrInvalidDenom.Wrapf("%q does not match %s", c.Denom, denomPattern)
+	}
+	if _, ok := denomDecimals(c.Denom); ok || ctx.denoms[c.Denom] {
+		return apperrors.ErrInvalidDenom.Wrapf("%q already exists", c.Denom)
+	}
+	decimals, err := strconv.ParseUint(c.Decimals, 10, 8)
+	if err != nil || decimals > maxAmountDecimals || strconv.FormatUint(decimals, 10) != c.Decimals {
+		return apperrors.ErrInvalidDecimals.Wrapf("%q", c.Decimals)
+	}
+	ctx.denoms[c.Denom] = true
+	return nil
+}
+
+// isValidIssuance checks that issuer may mint or burn amount of denom and
+// returns the parsed amount
+func isValidIssuance(denom, issuer, amount string) (Amount, error) {
+	// The native asset has no issuer
+	if denom == nativeDenom() {
+		return Amount{}, apperrors.ErrNotIssuer.Wrapf("%s is the native asset", denom)
+	}
+	asset, ok := assetMap[denom]
+	if !ok {
+		return Amount{}, apperrors.ErrUnknownDenom.Wrapf("%q", denom)
+	}
+	if asset.Issuer == "" || asset.Issuer != issuer {
+		return Amount{}, apperrors.ErrNotIssuer.Wrapf("%s does not issue %s", issuer, denom)
+	}
+	value, err := ParsePositiveAmount(amount, asset.Decimals)
+	if err != nil {
+		return Amount{}, apperrors.ErrInvalidAmount.Wrapf("%q: %v", amount, err)
+	}
+	return value, nil
+}
+
+func isValidMint(m *Mint, ctx *txContext) error {
+	if _, ok := keyMap[m.Dest]; !ok {
+		return apperrors.ErrUnknownRecipient.Wrapf("%q", m.Dest)
+	}
+	amount, err := isValidIssuance(m.Denom, m.Issuer, m.Amount)
+	if err != nil {
+		return err
+	}
+	// Both the supply and the minted counter must stay within range
+	minted, err := ctx.mints[m.Denom].Add(amount)
+	if err != nil {
+		return apperrors.ErrSupplyOverflow.Wrapf("minting %s %s", m.Amount, m.Denom)
+	}
+	supply := supplyMap[m.Denom]
+	total, err := totalSupply(m.Denom)
+	if err != nil {
+		return apperrors.ErrSupplyOverflow.Wrapf("%v", err)
+	}
+	if _, err := total.Add(minted); err != nil {
+		return apperrors.ErrSupplyOverflow.Wrapf("minting %s %s", m.Amount, m.Denom)
+	}
+	if _, err := supply.Minted.Add(minted); err != nil {
+		return apperrors.ErrSupplyOverflow.Wrapf("minted %s", m.Denom)
+	}
+	ctx.mints[m.Denom] = minted
+	return nil
+}
+
+func isValidBurn(b *Burn, ctx *txContext) error {
+	if _, ok := keyMap[b.Account]; !ok {
+		return apperrors.ErrUnknownRecipient.Wrapf("%q", b.Account)
+	}
+	amount, err := isValidIssuance(b.Denom, b.Issuer, b.Amount)
+	if err != nil {
+		return err
+	}
+	supply := supplyMap[b.Denom]
+	if _, err := supply.Burned.Add(amount); err != nil {
+		return apperrors.ErrSupplyOverflow.Wrapf("burned %s", b.Denom)
+	}
+	return ctx.debit(b.Denom, b.Account, amount)
+}
+
+func (app *KVStoreApplication) executeCreateAsset(c *CreateAsset) (abcitypes.Event, error) {
+	decimals, err := strconv.ParseUint(c.Decimals, 10, 8)
+	if err != nil {
+		return abcitypes.Event{}, apperrors.ErrInvalidDecimals.Wrapf("%q", c.Decimals)
+	}
+	if err := app.setAsset(c.Denom, &Asset{Decimals: uint8(decimals), Issuer: c.Issuer}); err != nil {
+		return abcitypes.Event{}, err
+	}
+	if err := app.setSupply(c.Denom, Supply{}); err != nil {
+		return abcitypes.Event{}, err
+	}
+
+	return abcitypes.Event{
+		Type: "asset_created",
+		Attributes: []abcitypes.EventAttribute{
+			{Key: "denom", Value: c.Denom, Index: true},
+			{Key: "issuer", Value: c.Issuer, Index: true},
+			{Key: "decimals", Value: c.Decimals, Index: false},
+		},
+	}, nil
+}
+
+func (app *KVStoreApplication) executeMint(m *Mint) (abcitypes.Event, error) {
+	asset, ok := assetMap[m.Denom]
+	if !ok {
+		return abcitypes.Event{}, apperrors.ErrUnknownDenom.Wrapf("%q", m.Denom)
+	}
+	amount, err := parseAmount(m.Amount, asset.Decimals)
+	if err != nil {
+		return abcitypes.Event{}, err
+	}
+
+	if err := app.mint(m.Denom, amount); err != nil {
+		return abcitypes.Event{}, err
+	}
+	if err := app.credit(m.Denom, m.Dest, amount); err != nil {
+		return abcitypes.Event{}, err
+	}
+
+	return abcitypes.Event{
+		Type: "mint",
+		Attributes: []abcitypes.EventAttribute{
+			{Key: "denom", Value: m.Denom, Index: true},
+			{Key: "dst", Value: m.Dest, Index: true},
+			{Key: "amount", Value: m.Amount, Index: true},
+		},
+	}, nil
+}
+
+func (app *KVStoreApplication) executeBurn(b *Burn) (abcitypes.Event, error) {
+	asset, ok := assetMap[b.Denom]
+	if !ok {
+		return abcitypes.Event{}, apperrors.ErrUnknownDenom.Wrapf("%q", b.Denom)
+	}
+	amount, err := parseAmount(b.Amount, asset.Decimals)
+	if err != nil {
+		return abcitypes.Event{}, err
+	}
+
+	if err := app.burn(b.Denom, amount); err != nil {
+		return abcitypes.Event{}, err
+	}
+	if err := app.debit(b.Denom, b.Account, amount); err != nil {
+		return abcitypes.Event{}, err
+	}
+
+	return abcitypes.Event{
+		Type: "burn",
+		Attributes: []abcitypes.EventAttribute{
+			{Key: "denom", Value: b.Denom, Index: true},
+			{Key: "src", Value: b.Account, Index: true},
+			{Key: "amount", Value: b.Amount, Index: true},
+		},
+	}, nil
+}
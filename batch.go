@@ -0,0 +1,130 @@
+package main
+
+import (
+	"test/db"
+)
+
+// txBatch buffers the writes of a transaction until it has fully run, so that
+// a transaction failing midway leaves nothing in the ongoing block. Buffered
+// writes only fail once the transaction runs out of gas, database errors
+// surface when the batch is flushed.
+type txBatch struct {
+	parent db.Transaction
+	ops    []func(db.Transaction) error
+	// gas is consumed by every write
+	gas *GasMeter
+}
+
+var _ db.Transaction = (*txBatch)(nil)
+
+// ledgerBatch is a txBatch for backends with native pending transfers
+type ledgerBatch struct {
+	*txBatch
+}
+
+var _ db.PendingTransfers = ledgerBatch{}
+
+// newTxBatch returns a batch writing to parent and metering its writes with
+// gas, which is a db.PendingTransfers if parent is
+func newTxBatch(parent db.Transaction, gas *GasMeter) db.Transaction {
+	batch := &txBatch{parent: parent, gas: gas}
+	if _, ok := parent.(db.PendingTransfers); ok {
+		return ledgerBatch{batch}
+	}
+	return batch
+}
+
+func (b *txBatch) Set(key []byte, value []byte) error {
+	if err := b.gas.Consume(gasPerWrite); err != nil {
+		return err
+	}
+	b.ops = append(b.ops, func(t db.Transaction) error { return t.Set(key, value) })
+	return nil
+}
+
+func (b *txBatch) Delete(key []byte) error {
+	if err := b.gas.Consume(gasPerWrite); err != nil {
+		return err
+	}
+	b.ops = append(b.ops, func(t db.Transaction) error { return t.Delete(key) })
+	return nil
+}
+
+// Commit applies the buffered writes to the parent transaction in order
+func (b *txBatch) Commit() error {
+	for _, op := range b.ops {
+		if err := op(b.parent); err != nil {
+			return err
+		}
+	}
+	b.ops = nil
+	return nil
+}
+
+func (b *txBatch) Rollback() error {
+	b.ops = nil
+	return nil
+}
+
+func (b ledgerBatch) CreatePending(id, debit, credit []byte, amount db.Uint128, timeout uint32) error {
+	if err := b.gas.Consume(gasPerWrite); err != nil {
+		return err
+	}
+	b.ops = append(b.ops, func(t db.Transaction) error {
+		return t.(db.PendingTransfers).CreatePending(id, debit, credit, amount, timeout)
+	})
+	return nil
+}
+
+func (b ledgerBatch) PostPending(id []byte, amount db.Uint128) error {
+	if err := b.gas.Consume(gasPerWrite); err != nil {
+		return err
+	}
+	b.ops = append(b.ops, func(t db.Transaction) error {
+		return t.(db.PendingTransfers).PostPending(id, amount)
+	})
+	return nil
+}
+
+func (b ledgerBatch) VoidPending(id []byte) error {
+	if err := b.gas.Consume(gasPerWrite); err != nil {
+		return err
+	}
+	b.ops = append(b.ops, func(t db.Transaction) error {
+		return t.(db.PendingTransfers).VoidPending(id)
+	})
+	return nil
+}
+
+// journal records how to undo a change to the in-memory state while a
+// transaction runs
+func (app *KVStoreApplication) journal(undo func()) {
+	if app.undo != nil {
+		app.undo = append(app.undo, undo)
+	}
+}
+
+// journalEntry records how to restore the current value of m[key], which
+// costs the transaction a read. Running out of gas is reported once the
+// transaction has run.
+func journalEntry[K comparable, V any](app *KVStoreApplication, m map[K]V, key K) {
+	if app.undo == nil {
+		return
+	}
+	app.gas.Consume(gasPerRead)
+	prev, ok := m[key]
+	app.journal(func() {
+		if ok {
+			m[key] = prev
+		} else {
+			delete(m, key)
+		}
+	})
+}
+
+// revert undoes the changes journaled since the transaction started, latest first
+func (app *KVStoreApplication) revert() {
+	for i := len(app.undo) - 1; i >= 0; i-- {
+		app.undo[i]()
+	}
+}
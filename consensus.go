@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"test/apperrors"
+	"test/db"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	cmtproto "github.com/cometbft/cometbft/api/cometbft/types/v1"
+	cmttypes "github.com/cometbft/cometbft/types"
+	gogotypes "github.com/cosmos/gogoproto/types"
+)
+
+// consensusParamsKey stores the consensus params in force as protobuf, since
+// CometBFT only sends them in InitChain
+var consensusParamsKey = []byte("meta/consensus_params")
+
+// consensusParams are the consensus params in force, nil if unknown
+var consensusParams *cmttypes.ConsensusParams
+
+// consensusUpdate merges the consensus param changes of the ongoing block,
+// nil if there are none
+var consensusUpdate *cmtproto.ConsensusParams
+
+// UpdateConsensusParams changes consensus params from the next block. Empty
+// fields are left unchanged. It must be signed by the admin account of the
+// params, who can use each id once.
+type UpdateConsensusParams struct {
+	Id                     string `json:"id"`
+	MaxBytes               string `json:"max_bytes,omitempty"`
+	MaxGas                 string `json:"max_gas,omitempty"`
+	EvidenceMaxAgeBlocks   string `json:"evidence_max_age_num_blocks,omitempty"`
+	EvidenceMaxAgeDuration string `json:"evidence_max_age_duration,omitempty"`
+	EvidenceMaxBytes       string `json:"evidence_max_bytes,omitempty"`
+	// VoteExtensionsEnableHeight is the first height votes carry extensions
+	// at, 0 to keep them disabled
+	VoteExtensionsEnableHeight string `json:"vote_extensions_enable_height,omitempty"`
+	Admin                      string `json:"admin"`
+	Signature                  string `json:"signature"`
+}
+
+// parseUpdateConsensusParams decodes
+// consensus=id=max_bytes=max_gas=evidence_max_age_num_blocks=evidence_max_age_duration=evidence_max_bytes=vote_extensions_enable_height=admin=signature.
+func parseUpdateConsensusParams(parts [][]byte) Msg {
+	if len(parts) != 10 {
+		return nil
+	}
+	return &UpdateConsensusParams{
+		Id:                         string(parts[1]),
+		MaxBytes:                   string(parts[2]),
+		MaxGas:                     string(parts[3]),
+		EvidenceMaxAgeBlocks:       string(parts[4]),
+		EvidenceMaxAgeDuration:     string(parts[5]),
+		EvidenceMaxBytes:           string(parts[6]),
+		VoteExtensionsEnableHeight: string(parts[7]),
+		Admin:                      string(parts[8]),
+		Signature:                  string(parts[9]),
+	}
+}
+
+func (u *UpdateConsensusParams) Signer() string { return u.Admin }
+
+func (u *UpdateConsensusParams) Sig() string { return u.Signature }
+
+func (u *UpdateConsensusParams) msgId() (string, string) { return "consensus", u.Id }
+
+// Challenge separates the fields since most of them can be empty
+func (u *UpdateConsensusParams) Challenge() []byte {
+	return []byte(strings.Join([]string{
+		"consensus", u.Id, u.MaxBytes, u.MaxGas, u.EvidenceMaxAgeBlocks, u.EvidenceMaxAgeDuration,
+		u.EvidenceMaxBytes, u.VoteExtensionsEnableHeight,
+	}, "="))
+}
+
+// parseParam parses an integer field of an update, def if it is empty
+func parseParam(name, s string, def int64) (int64, error) {
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || strconv.FormatInt(v, 10) != s {
+		return 0, apperrors.ErrInvalidConsensusParams.Wrapf("invalid %s %q", name, s)
+	}
+	return v, nil
+}
+
+// consensusParamsUpdate merges u into the changes of the ongoing block and
+// checks the result the way CometBFT will when the block at height ends
+func consensusParamsUpdate(u *UpdateConsensusParams, height int64) (*cmtproto.ConsensusParams, error) {
+	if consensusParams == nil {
+		return nil, apperrors.ErrInvalidConsensusParams.Wrapf("the consensus params in force are unknown")
+	}
+	current := consensusParams.Update(consensusUpdate)
+	update := &cmtproto.ConsensusParams{}
+	if consensusUpdate != nil {
+		// Sections are replaced, never modified
+		copied := *consensusUpdate
+		update = &copied
+	}
+	changed := false
+
+	if u.MaxBytes != "" || u.MaxGas != "" {
+		maxBytes, err := parseParam("max_bytes", u.MaxBytes, current.Block.MaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		maxGas, err := parseParam("max_gas", u.MaxGas, current.Block.MaxGas)
+		if err != nil {
+			return nil, err
+		}
+		update.Block = &cmtproto.BlockParams{MaxBytes: maxBytes, MaxGas: maxGas}
+		changed = true
+	}
+
+	if u.EvidenceMaxAgeBlocks != "" || u.EvidenceMaxAgeDuration != "" || u.EvidenceMaxBytes != "" {
+		maxAgeBlocks, err := parseParam("evidence_max_age_num_blocks", u.EvidenceMaxAgeBlocks, current.Evidence.MaxAgeNumBlocks)
+		if err != nil {
+			return nil, err
+		}
+		maxAgeDuration := current.Evidence.MaxAgeDuration
+		if u.EvidenceMaxAgeDuration != "" {
+			if maxAgeDuration, err = time.ParseDuration(u.EvidenceMaxAgeDuration); err != nil {
+				return nil, apperrors.ErrInvalidConsensusParams.Wrapf("invalid evidence_max_age_duration %q", u.EvidenceMaxAgeDuration)
+			}
+		}
+		maxBytes, err := parseParam("evidence_max_bytes", u.EvidenceMaxBytes, current.Evidence.MaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		update.Evidence = &cmtproto.EvidenceParams{MaxAgeNumBlocks: maxAgeBlocks, MaxAgeDuration: maxAgeDuration, MaxBytes: maxBytes}
+		changed = true
+	}
+
+	if u.VoteExtensionsEnableHeight != "" {
+		enableHeight, err := parseParam("vote_extensions_enable_height", u.VoteExtensionsEnableHeight, 0)
+		if err != nil {
+			return nil, err
+		}
+		feature := &cmtproto.FeatureParams{}
+		if update.Feature != nil {
+			*feature = *update.Feature
+		}
+		feature.VoteExtensionsEnableHeight = &gogotypes.Int64Value{Value: enableHeight}
+		update.Feature = feature
+		changed = true
+	}
+
+	if !changed {
+		return nil, apperrors.ErrInvalidConsensusParams.Wrapf("no param is changed")
+	}
+	if err := consensusParams.ValidateUpdate(update, height); err != nil {
+		return nil, apperrors.ErrInvalidConsensusParams.Wrapf("%v", err)
+	}
+	if err := consensusParams.Update(update).ValidateBasic(); err != nil {
+		return nil, apperrors.ErrInvalidConsensusParams.Wrapf("%v", err)
+	}
+	return update, nil
+}
+
+func isValidUpdateConsensusParams(u *UpdateConsensusParams, ctx *txContext) error {
+	if params.Admin == "" || u.Admin != params.Admin {
+		return apperrors.ErrUnauthorized.Wrapf("%s is not the admin", u.Admin)
+	}
+	if ctx.consensusUpdated {
+		return apperrors.ErrInvalidConsensusParams.Wrapf("consensus params are updated twice")
+	}
+	if _, err := consensusParamsUpdate(u, ctx.height); err != nil {
+		return err
+	}
+	ctx.consensusUpdated = true
+	return nil
+}
+
+func (app *KVStoreApplication) executeUpdateConsensusParams(u *UpdateConsensusParams) (abcitypes.Event, error) {
+	update, err := consensusParamsUpdate(u, app.executingHeight())
+	if err != nil {
+		return abcitypes.Event{}, err
+	}
+	prev := consensusUpdate
+	app.journal(func() { consensusUpdate = prev })
+	consensusUpdate = update
+
+	var attributes []abcitypes.EventAttribute
+	for _, field := range []struct{ key, value string }{
+		{"max_bytes", u.MaxBytes},
+		{"max_gas", u.MaxGas},
+		{"evidence_max_age_num_blocks", u.EvidenceMaxAgeBlocks},
+		{"evidence_max_age_duration", u.EvidenceMaxAgeDuration},
+		{"evidence_max_bytes", u.EvidenceMaxBytes},
+		{"vote_extensions_enable_height", u.VoteExtensionsEnableHeight},
+	} {
+		if field.value != "" {
+			attributes = append(attributes, abcitypes.EventAttribute{Key: field.key, Value: field.value, Index: false})
+		}
+	}
+	return abcitypes.Event{Type: "consensus_params", Attributes: attributes}, nil
+}
+
+// applyConsensusUpdate puts the consensus param changes of the block in force
+// and returns them for FinalizeBlockResponse.ConsensusParamUpdates
+func (app *KVStoreApplication) applyConsensusUpdate() (*cmtproto.ConsensusParams, error) {
+	update := consensusUpdate
+	if update == nil {
+		return nil, nil
+	}
+	consensusUpdate = nil
+	next := consensusParams.Update(update)
+	if err := app.setConsensusParams(next); err != nil {
+		return nil, err
+	}
+	if err := app.setBlockLimits(next.Block.MaxBytes, next.Block.MaxGas); err != nil {
+		return nil, err
+	}
+	return update, nil
+}
+
+// setConsensusParams records the consensus params in force in the ongoing block
+func (app *KVStoreApplication) setConsensusParams(p cmttypes.ConsensusParams) error {
+	consensusParams = &p
+	encoded := p.ToProto()
+	value, err := encoded.Marshal()
+	if err != nil {
+		return fmt.Errorf("encoding consensus params: %w", err)
+	}
+	if err := app.onGoingBlock.Set(consensusParamsKey, value); err != nil {
+		return fmt.Errorf("writing consensus params: %w", err)
+	}
+	return nil
+}
+
+// loadConsensusParams restores the consensus params in force
+func (app *KVStoreApplication) loadConsensusParams() error {
+	consensusParams = nil
+	value, err := app.db.Get(consensusParamsKey)
+	if errors.Is(err, db.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var stored cmtproto.ConsensusParams
+	if err := stored.Unmarshal(value); err != nil {
+		return fmt.Errorf("invalid stored consensus params: %w", err)
+	}
+	p := cmttypes.ConsensusParamsFromProto(stored)
+	consensusParams = &p
+	return nil
+}
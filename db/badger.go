@@ -1,21 +1,94 @@
 package db
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
 	"github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/badger/v4/options"
 )
 
 // BadgerDB implements the DB interface using Badger
 type BadgerDB struct {
-	db *badger.DB
+	db     *badger.DB
+	policy *syncPolicy
 }
 
 // NewBadgerDB creates a new BadgerDB instance
-func NewBadgerDB(path string) (DB, error) {
-	db, err := badger.Open(badger.DefaultOptions(path))
+func NewBadgerDB(path string, opts BadgerOptions) (DB, error) {
+	badgerOpts, err := opts.badgerOptions(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := badger.Open(badgerOpts)
 	if err != nil {
 		return nil, err
 	}
-	return &BadgerDB{db: db}, nil
+	b := &BadgerDB{db: db, policy: &syncPolicy{opts: opts.DurabilityOptions}}
+	if err := b.replayJournal(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("replaying badger journal: %w", err)
+	}
+	return b, nil
+}
+
+// badgerOptions applies the tuning options on top of Badger's defaults
+func (o BadgerOptions) badgerOptions(path string) (badger.Options, error) {
+	if err := o.DurabilityOptions.Validate(); err != nil {
+		return badger.Options{}, err
+	}
+	// Syncing is driven by the durability mode rather than by Badger itself
+	opts := badger.DefaultOptions(path).WithSyncWrites(false)
+	if o.BlockCacheSize > 0 {
+		opts = opts.WithBlockCacheSize(o.BlockCacheSize)
+	}
+	if o.IndexCacheSize > 0 {
+		opts = opts.WithIndexCacheSize(o.IndexCacheSize)
+	}
+	if o.MemTableSize > 0 {
+		opts = opts.WithMemTableSize(o.MemTableSize)
+	}
+	if o.NumMemtables > 0 {
+		opts = opts.WithNumMemtables(o.NumMemtables)
+	}
+	if o.ValueThreshold > 0 {
+		opts = opts.WithValueThreshold(o.ValueThreshold)
+	}
+	if o.ValueLogFileSize > 0 {
+		opts = opts.WithValueLogFileSize(o.ValueLogFileSize)
+	}
+
+	switch o.Compression {
+	case "":
+	case "none":
+		opts = opts.WithCompression(options.None)
+	case "snappy":
+		opts = opts.WithCompression(options.Snappy)
+	case "zstd":
+		opts = opts.WithCompression(options.ZSTD)
+	default:
+		return opts, fmt.Errorf("unknown badger compression: %s", o.Compression)
+	}
+
+	switch o.LogLevel {
+	case "":
+	case "debug":
+		opts = opts.WithLoggingLevel(badger.DEBUG)
+	case "info":
+		opts = opts.WithLoggingLevel(badger.INFO)
+	case "warning":
+		opts = opts.WithLoggingLevel(badger.WARNING)
+	case "error":
+		opts = opts.WithLoggingLevel(badger.ERROR)
+	default:
+		return opts, fmt.Errorf("unknown badger log level: %s", o.LogLevel)
+	}
+	return opts, nil
 }
 
 // Get retrieves a value for the given key
@@ -44,14 +117,90 @@ func (b *BadgerDB) Get(key []byte) ([]byte, error) {
 
 // Set stores a key-value pair
 func (b *BadgerDB) Set(key []byte, value []byte) error {
-	return b.db.Update(func(txn *badger.Txn) error {
+	err := b.db.Update(func(txn *badger.Txn) error {
 		return txn.Set(key, value)
 	})
+	if err != nil || !b.policy.opts.syncsWrites() {
+		return err
+	}
+	return b.db.Sync()
+}
+
+// Iterate calls fn for every key starting with prefix, in key order
+func (b *BadgerDB) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	return b.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: true, PrefetchSize: 100, Prefix: prefix})
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if err := fn(item.KeyCopy(nil), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 // BeginTx starts a new transaction
 func (b *BadgerDB) BeginTx() (Transaction, error) {
-	return &BadgerTransaction{txn: b.db.NewTransaction(true)}, nil
+	return &BadgerTransaction{db: b, writes: make(map[string][]byte)}, nil
+}
+
+// badgerGCDiscardRatio is the fraction of a value log file that must be stale
+// for RunValueLogGC to rewrite it
+const badgerGCDiscardRatio = 0.5
+
+var _ Maintainer = (*BadgerDB)(nil)
+
+// RunMaintenance garbage collects the value log until no file can be rewritten
+func (b *BadgerDB) RunMaintenance() error {
+	for {
+		err := b.db.RunValueLogGC(badgerGCDiscardRatio)
+		if errors.Is(err, badger.ErrNoRewrite) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// DiskUsage returns the size of the database files. Badger's own Size is only
+// refreshed once a minute, so the files are measured directly.
+func (b *BadgerDB) DiskUsage() (DiskUsage, error) {
+	var usage DiskUsage
+	opts := b.db.Opts()
+	dirs := []string{opts.Dir}
+	if opts.ValueDir != opts.Dir {
+		dirs = append(dirs, opts.ValueDir)
+	}
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return usage, err
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			size := allocatedSize(info)
+			switch filepath.Ext(entry.Name()) {
+			case ".sst":
+				usage.Tables += size
+			case ".vlog":
+				usage.ValueLog += size
+			case ".mem":
+				usage.WAL += size
+			}
+			usage.Total += size
+		}
+	}
+	return usage, nil
 }
 
 // Close closes the database
@@ -59,23 +208,246 @@ func (b *BadgerDB) Close() error {
 	return b.db.Close()
 }
 
-// BadgerTransaction implements the Transaction interface for Badger
+// BadgerTransaction implements the Transaction interface for Badger. Writes
+// are buffered until Commit, which applies them in a single Badger
+// transaction when they fit and falls back to a journaled write batch when
+// they exceed Badger's transaction size limits.
 type BadgerTransaction struct {
-	txn *badger.Txn
+	db *BadgerDB
+	// writes holds the value of each key written, nil for deleted keys
+	writes map[string][]byte
 }
 
 // Set stores a key-value pair within a transaction
 func (t *BadgerTransaction) Set(key []byte, value []byte) error {
-	return t.txn.Set(key, value)
+	t.writes[string(key)] = append([]byte{}, value...)
+	return nil
 }
 
-// Commit commits the transaction
+// Delete removes a key within a transaction
+func (t *BadgerTransaction) Delete(key []byte) error {
+	t.writes[string(key)] = nil
+	return nil
+}
+
+// Commit commits the transaction, syncing it if the durability mode requires it
 func (t *BadgerTransaction) Commit() error {
-	return t.txn.Commit()
+	if err := t.commit(); err != nil {
+		return err
+	}
+	t.writes = make(map[string][]byte)
+	if !t.db.policy.next() {
+		return nil
+	}
+	return t.db.db.Sync()
+}
+
+func (t *BadgerTransaction) commit() error {
+	txn := t.db.db.NewTransaction(true)
+	defer txn.Discard()
+	for key, value := range t.writes {
+		var err error
+		if value == nil {
+			err = txn.Delete([]byte(key))
+		} else {
+			err = txn.Set([]byte(key), value)
+		}
+		if err != nil {
+			if errors.Is(err, badger.ErrTxnTooBig) {
+				return t.db.commitLarge(t.writes)
+			}
+			return err
+		}
+	}
+	return txn.Commit()
 }
 
 // Rollback aborts the transaction
 func (t *BadgerTransaction) Rollback() error {
-	t.txn.Discard()
+	t.writes = make(map[string][]byte)
 	return nil
 }
+
+// badgerJournalKey holds the number of chunks of the journal of a block too
+// large for one Badger transaction while its writes are being applied. The
+// chunks are stored under badgerJournalPrefix, since a single value can't
+// exceed a value log file. Committing the journal key is the atomic commit
+// point of the block: a journal found on open is applied again, and chunks
+// without it are discarded.
+var (
+	badgerJournalKey    = []byte("!badger/journal")
+	badgerJournalPrefix = []byte("!badger/journal/")
+)
+
+// badgerJournalChunkSize bounds the chunks of the journal
+const badgerJournalChunkSize = 16 << 20
+
+// commitLarge applies writes that exceed Badger's transaction limits. The
+// writes are first committed as a journal, which Badger keeps in the value
+// log, then applied through a WriteBatch spanning as many transactions as
+// needed, and finally the journal is removed.
+func (b *BadgerDB) commitLarge(writes map[string][]byte) error {
+	// Leftovers of a journal that was never committed
+	if err := b.deleteJournal(); err != nil {
+		return err
+	}
+	journal := encodeJournal(writes)
+	chunkSize := min(badgerJournalChunkSize, int(b.db.Opts().ValueLogFileSize/4))
+	chunks := 0
+	for len(journal) > 0 {
+		chunk := journal[:min(chunkSize, len(journal))]
+		journal = journal[len(chunk):]
+		err := b.db.Update(func(txn *badger.Txn) error {
+			return txn.Set(journalChunkKey(chunks), chunk)
+		})
+		if err != nil {
+			return fmt.Errorf("writing journal chunk %d: %w", chunks, err)
+		}
+		chunks++
+	}
+	err := b.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(badgerJournalKey, binary.AppendUvarint(nil, uint64(chunks)))
+	})
+	if err != nil {
+		return fmt.Errorf("writing journal: %w", err)
+	}
+	// The journal must be on disk before any of its writes are
+	if err := b.db.Sync(); err != nil {
+		return err
+	}
+	return b.applyJournal(writes)
+}
+
+func journalChunkKey(i int) []byte {
+	return fmt.Appendf(bytes.Clone(badgerJournalPrefix), "%08d", i)
+}
+
+// replayJournal applies the journal left behind by a crash during commitLarge
+func (b *BadgerDB) replayJournal() error {
+	value, err := b.Get(badgerJournalKey)
+	if errors.Is(err, ErrKeyNotFound) {
+		return b.deleteJournal()
+	}
+	if err != nil {
+		return err
+	}
+	chunks, n := binary.Uvarint(value)
+	if n <= 0 {
+		return errors.New("corrupt badger journal")
+	}
+	var journal []byte
+	for i := 0; i < int(chunks); i++ {
+		chunk, err := b.Get(journalChunkKey(i))
+		if err != nil {
+			return fmt.Errorf("reading journal chunk %d: %w", i, err)
+		}
+		journal = append(journal, chunk...)
+	}
+	writes, err := decodeJournal(journal)
+	if err != nil {
+		return err
+	}
+	return b.applyJournal(writes)
+}
+
+// applyJournal writes every journaled key and then removes the journal
+func (b *BadgerDB) applyJournal(writes map[string][]byte) error {
+	wb := b.db.NewWriteBatch()
+	defer wb.Cancel()
+	for key, value := range writes {
+		var err error
+		if value == nil {
+			err = wb.Delete([]byte(key))
+		} else {
+			err = wb.Set([]byte(key), value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+	err := b.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(badgerJournalKey)
+	})
+	if err != nil {
+		return err
+	}
+	return b.deleteJournal()
+}
+
+// deleteJournal removes the chunks of a journal
+func (b *BadgerDB) deleteJournal() error {
+	var keys [][]byte
+	err := b.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: badgerJournalPrefix})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	wb := b.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, key := range keys {
+		if err := wb.Delete(key); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+// encodeJournal serializes writes as length-prefixed keys and values, sorted
+// by key. Values are prefixed with their length plus one, and deletions with 0.
+func encodeJournal(writes map[string][]byte) []byte {
+	keys := make([]string, 0, len(writes))
+	size := 0
+	for key, value := range writes {
+		keys = append(keys, key)
+		size += len(key) + len(value) + 2*binary.MaxVarintLen64
+	}
+	sort.Strings(keys)
+
+	buf := make([]byte, 0, size)
+	for _, key := range keys {
+		buf = binary.AppendUvarint(buf, uint64(len(key)))
+		buf = append(buf, key...)
+		if writes[key] == nil {
+			buf = binary.AppendUvarint(buf, 0)
+			continue
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(writes[key]))+1)
+		buf = append(buf, writes[key]...)
+	}
+	return buf
+}
+
+// decodeJournal parses a journal written by encodeJournal
+func decodeJournal(buf []byte) (map[string][]byte, error) {
+	writes := make(map[string][]byte)
+	for len(buf) > 0 {
+		keyLen, read := binary.Uvarint(buf)
+		if read <= 0 || uint64(len(buf)-read) < keyLen {
+			return nil, errors.New("corrupt badger journal")
+		}
+		key := string(buf[read : read+int(keyLen)])
+		buf = buf[read+int(keyLen):]
+
+		valueLen, read := binary.Uvarint(buf)
+		if read <= 0 || (valueLen > 0 && uint64(len(buf)-read) < valueLen-1) {
+			return nil, errors.New("corrupt badger journal")
+		}
+		buf = buf[read:]
+		if valueLen == 0 {
+			writes[key] = nil
+			continue
+		}
+		writes[key] = buf[:valueLen-1]
+		buf = buf[valueLen-1:]
+	}
+	return writes, nil
+}
@@ -0,0 +1,154 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// smallBadgerOptions makes Badger's transaction and value log limits small
+// enough for a test block to exceed them
+var smallBadgerOptions = BadgerOptions{
+	MemTableSize:     1 << 20,
+	ValueThreshold:   1 << 10,
+	ValueLogFileSize: 1 << 20,
+	LogLevel:         "error",
+}
+
+func largeBlock(n int) map[string][]byte {
+	writes := make(map[string][]byte, n)
+	for i := 0; i < n; i++ {
+		writes[fmt.Sprintf("key/%06d", i)] = bytes.Repeat([]byte{byte(i)}, 200)
+	}
+	return writes
+}
+
+func checkWrites(t *testing.T, database DB, writes map[string][]byte) {
+	t.Helper()
+	for key, value := range writes {
+		got, err := database.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("reading %s: %v", key, err)
+		}
+		if !bytes.Equal(got, value) {
+			t.Fatalf("%s is %x, want %x", key, got, value)
+		}
+	}
+	if _, err := database.Get(badgerJournalKey); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("journal key is still stored: %v", err)
+	}
+	err := database.Iterate(badgerJournalPrefix, func(key, _ []byte) error {
+		return fmt.Errorf("journal chunk %s is still stored", key)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBadgerJournalReplayedOnOpen(t *testing.T) {
+	dir := t.TempDir()
+	database, err := NewBadgerDB(dir, smallBadgerOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := database.(*BadgerDB)
+	writes := largeBlock(10000)
+
+	// A crash after the journal is committed but before its writes are applied
+	journal := encodeJournal(writes)
+	chunks := 0
+	for ; len(journal) > 0; chunks++ {
+		chunk := journal[:min(256<<10, len(journal))]
+		journal = journal[len(chunk):]
+		if err := b.Set(journalChunkKey(chunks), chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if chunks < 2 {
+		t.Fatalf("the journal has %d chunk", chunks)
+	}
+	if err := b.Set(badgerJournalKey, []byte{byte(chunks)}); err != nil {
+		t.Fatal(err)
+	}
+	// and chunks of an uncommitted journal from an earlier crash
+	if err := b.Set(journalChunkKey(chunks), []byte("stale")); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	database, err = NewBadgerDB(dir, smallBadgerOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	checkWrites(t, database, writes)
+}
+
+func TestBadgerUncommittedJournalDiscardedOnOpen(t *testing.T) {
+	dir := t.TempDir()
+	database, err := NewBadgerDB(dir, smallBadgerOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := database.(*BadgerDB)
+	if err := b.Set(journalChunkKey(0), encodeJournal(map[string][]byte{"key": []byte("value")})); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	database, err = NewBadgerDB(dir, smallBadgerOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	if _, err := database.Get([]byte("key")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("write of an uncommitted journal is applied: %v", err)
+	}
+	checkWrites(t, database, nil)
+}
+
+func TestBadgerLargeCommitDeletes(t *testing.T) {
+	dir := t.TempDir()
+	database, err := NewBadgerDB(dir, smallBadgerOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Set([]byte("deleted"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	writes := largeBlock(10000)
+
+	tx, err := database.BeginTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range writes {
+		if err := tx.Set([]byte(key), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Delete([]byte("deleted")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("committing a large block: %v", err)
+	}
+	if err := database.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	database, err = NewBadgerDB(dir, smallBadgerOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	checkWrites(t, database, writes)
+	if _, err := database.Get([]byte("deleted")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("deleted key is still stored: %v", err)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package db
+
+import (
+	"os"
+)
+
+// allocatedSize returns the disk space used by a file
+func allocatedSize(info os.FileInfo) int64 {
+	return info.Size()
+}
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"fmt"
+)
+
+// Durability selects which block commits are synced to disk
+type Durability string
+
+const (
+	// DurabilitySync syncs every block commit
+	DurabilitySync Durability = "sync"
+	// DurabilityGroup syncs every SyncEvery block commits
+	DurabilityGroup Durability = "group"
+	// DurabilityNone never syncs explicitly, blocks lost in a crash are
+	// replayed by CometBFT on restart
+	DurabilityNone Durability = "none"
+)
+
+// DurabilityOptions configures when a backend syncs block commits. An empty
+// mode is the same as DurabilitySync.
+type DurabilityOptions struct {
+	Durability Durability `mapstructure:"durability"`
+	SyncEvery  int        `mapstructure:"sync_every"`
+}
+
+// Validate checks the durability mode and group size
+func (o DurabilityOptions) Validate() error {
+	switch o.Durability {
+	case "", DurabilitySync, DurabilityNone:
+		return nil
+	case DurabilityGroup:
+		if o.SyncEvery < 1 {
+			return fmt.Errorf("group durability requires sync_every >= 1, got %d", o.SyncEvery)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown durability mode: %s", o.Durability)
+}
+
+// syncsWrites reports whether writes outside of block commits must be synced
+func (o DurabilityOptions) syncsWrites() bool {
+	return o.Durability == "" || o.Durability == DurabilitySync
+}
+
+// syncPolicy counts block commits to decide which of them must be synced.
+// Commits are serialized by the application, so no locking is needed.
+type syncPolicy struct {
+	opts    DurabilityOptions
+	commits int
+}
+
+// next records a block commit and reports whether it must be synced
+func (p *syncPolicy) next() bool {
+	switch p.opts.Durability {
+	case "", DurabilitySync:
+		return true
+	case DurabilityGroup:
+		p.commits++
+		if p.commits >= p.opts.SyncEvery {
+			p.commits = 0
+			return true
+		}
+	}
+	return false
+}
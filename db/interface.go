@@ -4,6 +4,8 @@ package db
 type DB interface {
 	Get(key []byte) ([]byte, error)
 	Set(key []byte, value []byte) error
+	// Iterate calls fn for every key starting with prefix, in key order
+	Iterate(prefix []byte, fn func(key, value []byte) error) error
 	BeginTx() (Transaction, error)
 	Close() error
 }
@@ -11,6 +13,21 @@ type DB interface {
 // Transaction defines the interface for transaction operations
 type Transaction interface {
 	Set(key []byte, value []byte) error
+	Delete(key []byte) error
 	Commit() error
 	Rollback() error
 }
+
+// PendingTransfers is implemented by transactions of backends that support
+// two-phase transfers natively. The application emulates pending transfers
+// with reserved balance keys on backends that don't implement it.
+type PendingTransfers interface {
+	CreatePending(id, debit, credit []byte, amount Uint128, timeout uint32) error
+	PostPending(id []byte, amount Uint128) error
+	VoidPending(id []byte) error
+}
+
+// Uint128 is an unsigned 128-bit amount split in its high and low 64 bits
+type Uint128 struct {
+	Hi, Lo uint64
+}
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// DiskUsage reports the on-disk size of a backend in bytes
+type DiskUsage struct {
+	Total    int64 `json:"total"`
+	Tables   int64 `json:"tables"`
+	ValueLog int64 `json:"value_log,omitempty"`
+	WAL      int64 `json:"wal,omitempty"`
+}
+
+// Maintainer is implemented by backends that need periodic storage maintenance
+// such as value-log garbage collection or compaction
+type Maintainer interface {
+	// RunMaintenance reclaims disk space. It is safe to call while blocks are
+	// being committed.
+	RunMaintenance() error
+	DiskUsage() (DiskUsage, error)
+}
+
+// MaintenanceStats describes the last maintenance run of a Scheduler
+type MaintenanceStats struct {
+	Runs      int           `json:"runs"`
+	LastRun   time.Time     `json:"last_run"`
+	Duration  time.Duration `json:"duration"`
+	LastError string        `json:"last_error,omitempty"`
+	Before    DiskUsage     `json:"before"`
+	After     DiskUsage     `json:"after"`
+}
+
+// Scheduler runs a backend's storage maintenance on a fixed interval
+type Scheduler struct {
+	maintainer Maintainer
+	interval   time.Duration
+
+	mu    sync.Mutex
+	stats MaintenanceStats
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewScheduler creates a scheduler for db. It returns nil if the backend has no
+// maintenance to run or interval is not positive; a nil Scheduler is a no-op.
+func NewScheduler(db DB, interval time.Duration) *Scheduler {
+	maintainer, ok := db.(Maintainer)
+	if !ok || interval <= 0 {
+		return nil
+	}
+	return &Scheduler{
+		maintainer: maintainer,
+		interval:   interval,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// Start runs maintenance in the background until Stop is called
+func (s *Scheduler) Start() {
+	if s == nil {
+		return
+	}
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.run()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the scheduler and waits for a running maintenance to finish
+func (s *Scheduler) Stop() {
+	if s == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+}
+
+// Stats returns the result of the last maintenance run
+func (s *Scheduler) Stats() MaintenanceStats {
+	if s == nil {
+		return MaintenanceStats{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+func (s *Scheduler) run() {
+	stats := MaintenanceStats{LastRun: time.Now()}
+	stats.Before, _ = s.maintainer.DiskUsage()
+	if err := s.maintainer.RunMaintenance(); err != nil {
+		stats.LastError = err.Error()
+		log.Printf("Storage maintenance failed: %v", err)
+	}
+	stats.After, _ = s.maintainer.DiskUsage()
+	stats.Duration = time.Since(stats.LastRun)
+
+	s.mu.Lock()
+	stats.Runs = s.stats.Runs + 1
+	s.stats = stats
+	s.mu.Unlock()
+
+	log.Printf("Storage maintenance done in %v, disk usage %d -> %d bytes",
+		stats.Duration, stats.Before.Total, stats.After.Total)
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"fmt"
+)
+
+// Option presets shared by the Badger and Pebble backends
+const (
+	PresetDefault    = "default"
+	PresetThroughput = "throughput"
+	PresetDurability = "durability"
+	PresetLowMemory  = "low-memory"
+)
+
+// BadgerOptions tunes the Badger backend. Zero values keep Badger's defaults.
+type BadgerOptions struct {
+	BlockCacheSize   int64  `mapstructure:"block_cache_size"`
+	IndexCacheSize   int64  `mapstructure:"index_cache_size"`
+	MemTableSize     int64  `mapstructure:"mem_table_size"`
+	NumMemtables     int    `mapstructure:"num_memtables"`
+	ValueThreshold   int64  `mapstructure:"value_threshold"`
+	ValueLogFileSize int64  `mapstructure:"value_log_file_size"`
+	Compression      string `mapstructure:"compression"` // none, snappy or zstd
+	LogLevel         string `mapstructure:"log_level"`   // debug, info, warning or error
+
+	DurabilityOptions `mapstructure:",squash"`
+}
+
+// PebbleOptions tunes the Pebble backend. Zero values keep Pebble's defaults.
+type PebbleOptions struct {
+	CacheSize             int64  `mapstructure:"cache_size"`
+	MemTableSize          uint64 `mapstructure:"mem_table_size"`
+	MaxOpenFiles          int    `mapstructure:"max_open_files"`
+	L0CompactionThreshold int    `mapstructure:"l0_compaction_threshold"`
+	BytesPerSync          int    `mapstructure:"bytes_per_sync"`
+	Compression           string `mapstructure:"compression"` // none, snappy or zstd
+	LogLevel              string `mapstructure:"log_level"`   // info or error
+
+	DurabilityOptions `mapstructure:",squash"`
+}
+
+// throughputDurability syncs in groups of blocks, relying on CometBFT to replay
+// the blocks of an unsynced group after a crash
+var throughputDurability = DurabilityOptions{Durability: DurabilityGroup, SyncEvery: 100}
+
+// BadgerPreset returns the Badger options for a named preset. An empty name
+// selects the default preset.
+func BadgerPreset(name string) (BadgerOptions, error) {
+	switch name {
+	case "", PresetDefault:
+		return BadgerOptions{}, nil
+	case PresetThroughput:
+		return BadgerOptions{
+			BlockCacheSize: 1 << 30,
+			IndexCacheSize: 256 << 20,
+			MemTableSize:   128 << 20,
+			NumMemtables:   8,
+			Compression:    "snappy",
+
+			DurabilityOptions: throughputDurability,
+		}, nil
+	case PresetDurability:
+		return BadgerOptions{
+			Compression: "zstd",
+
+			DurabilityOptions: DurabilityOptions{Durability: DurabilitySync},
+		}, nil
+	case PresetLowMemory:
+		return BadgerOptions{
+			BlockCacheSize:   8 << 20,
+			IndexCacheSize:   8 << 20,
+			MemTableSize:     8 << 20,
+			NumMemtables:     2,
+			ValueThreshold:   64 << 10,
+			ValueLogFileSize: 64 << 20,
+			Compression:      "none",
+		}, nil
+	}
+	return BadgerOptions{}, fmt.Errorf("unknown badger preset: %s", name)
+}
+
+// PebblePreset returns the Pebble options for a named preset. An empty name
+// selects the default preset.
+func PebblePreset(name string) (PebbleOptions, error) {
+	switch name {
+	case "", PresetDefault:
+		return PebbleOptions{}, nil
+	case PresetThroughput:
+		return PebbleOptions{
+			CacheSize:             1 << 30,
+			MemTableSize:          128 << 20,
+			MaxOpenFiles:          4096,
+			L0CompactionThreshold: 4,
+			Compression:           "snappy",
+
+			DurabilityOptions: throughputDurability,
+		}, nil
+	case PresetDurability:
+		return PebbleOptions{
+			BytesPerSync: 512 << 10,
+			Compression:  "zstd",
+
+			DurabilityOptions: DurabilityOptions{Durability: DurabilitySync},
+		}, nil
+	case PresetLowMemory:
+		return PebbleOptions{
+			CacheSize:    8 << 20,
+			MemTableSize: 4 << 20,
+			MaxOpenFiles: 256,
+			Compression:  "none",
+		}, nil
+	}
+	return PebbleOptions{}, fmt.Errorf("unknown pebble preset: %s", name)
+}
@@ -1,21 +1,93 @@
 package db
 
 import (
+	"fmt"
+	"log"
+
 	"github.com/cockroachdb/pebble"
 )
 
 // PebbleDB implements the DB interface using Pebble
 type PebbleDB struct {
-	db *pebble.DB
+	db     *pebble.DB
+	policy *syncPolicy
 }
 
 // NewPebbleDB creates a new PebbleDB instance
-func NewPebbleDB(path string) (DB, error) {
-	db, err := pebble.Open(path, &pebble.Options{})
+func NewPebbleDB(path string, opts PebbleOptions) (DB, error) {
+	return openPebbleDB(path, opts)
+}
+
+// openPebbleDB opens the Pebble database at path
+func openPebbleDB(path string, opts PebbleOptions) (*PebbleDB, error) {
+	pebbleOpts, err := opts.pebbleOptions()
+	if err != nil {
+		return nil, err
+	}
+	if pebbleOpts.Cache != nil {
+		// The DB holds its own reference to the cache
+		defer pebbleOpts.Cache.Unref()
+	}
+	db, err := pebble.Open(path, pebbleOpts)
 	if err != nil {
 		return nil, err
 	}
-	return &PebbleDB{db: db}, nil
+	return &PebbleDB{db: db, policy: &syncPolicy{opts: opts.DurabilityOptions}}, nil
+}
+
+// pebbleOptions builds the Pebble options from the tuning options
+func (o PebbleOptions) pebbleOptions() (*pebble.Options, error) {
+	if err := o.DurabilityOptions.Validate(); err != nil {
+		return nil, err
+	}
+	opts := &pebble.Options{
+		MemTableSize:          o.MemTableSize,
+		MaxOpenFiles:          o.MaxOpenFiles,
+		L0CompactionThreshold: o.L0CompactionThreshold,
+		BytesPerSync:          o.BytesPerSync,
+	}
+
+	var compression pebble.Compression
+	switch o.Compression {
+	case "":
+		compression = pebble.DefaultCompression
+	case "none":
+		compression = pebble.NoCompression
+	case "snappy":
+		compression = pebble.SnappyCompression
+	case "zstd":
+		compression = pebble.ZstdCompression
+	default:
+		return nil, fmt.Errorf("unknown pebble compression: %s", o.Compression)
+	}
+	if compression != pebble.DefaultCompression {
+		opts.Levels = make([]pebble.LevelOptions, 7)
+		for i := range opts.Levels {
+			opts.Levels[i].Compression = compression
+		}
+	}
+
+	switch o.LogLevel {
+	case "", "info":
+	case "error":
+		opts.Logger = quietPebbleLogger{}
+	default:
+		return nil, fmt.Errorf("unknown pebble log level: %s", o.LogLevel)
+	}
+
+	if o.CacheSize > 0 {
+		opts.Cache = pebble.NewCache(o.CacheSize)
+	}
+	return opts, nil
+}
+
+// quietPebbleLogger drops Pebble's informational messages
+type quietPebbleLogger struct{}
+
+func (quietPebbleLogger) Infof(format string, args ...interface{}) {}
+
+func (quietPebbleLogger) Fatalf(format string, args ...interface{}) {
+	log.Fatalf(format, args...)
 }
 
 // Get retrieves a value for the given key
@@ -35,24 +107,98 @@ func (p *PebbleDB) Get(key []byte) ([]byte, error) {
 	return result, nil
 }
 
+// writeOpts returns the write options for writes outside of block commits
+func (p *PebbleDB) writeOpts() *pebble.WriteOptions {
+	if p.policy.opts.syncsWrites() {
+		return pebble.Sync
+	}
+	return pebble.NoSync
+}
+
 // Set stores a key-value pair
 func (p *PebbleDB) Set(key []byte, value []byte) error {
-	return p.db.Set(key, value, pebble.Sync)
+	return p.db.Set(key, value, p.writeOpts())
 }
 
 // Delete removes a key-value pair
 func (p *PebbleDB) Delete(key []byte) error {
-	return p.db.Delete(key, pebble.Sync)
+	return p.db.Delete(key, p.writeOpts())
+}
+
+// Iterate calls fn for every key starting with prefix, in key order
+func (p *PebbleDB) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	iter, err := p.db.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		// Copy the key and value since they are only valid until the next step
+		key := append([]byte{}, iter.Key()...)
+		value := append([]byte{}, iter.Value()...)
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+// prefixUpperBound returns the smallest key greater than every key starting
+// with prefix, or nil if there is none
+func prefixUpperBound(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	return nil
 }
 
 // BeginTx starts a new transaction
 func (p *PebbleDB) BeginTx() (Transaction, error) {
 	batch := p.db.NewBatch()
 	return &PebbleTransaction{
-		db:    p.db,
+		db:    p,
 		batch: batch}, nil
 }
 
+var _ Maintainer = (*PebbleDB)(nil)
+
+// RunMaintenance compacts the whole key range, dropping overwritten values
+func (p *PebbleDB) RunMaintenance() error {
+	iter, err := p.db.NewIter(nil)
+	if err != nil {
+		return err
+	}
+	var first, last []byte
+	if iter.First() {
+		first = append([]byte{}, iter.Key()...)
+	}
+	if iter.Last() {
+		last = append([]byte{}, iter.Key()...)
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	if first == nil {
+		return nil
+	}
+	// The end key is exclusive
+	return p.db.Compact(first, append(last, 0), true)
+}
+
+// DiskUsage returns the size of the sstables and write-ahead log
+func (p *PebbleDB) DiskUsage() (DiskUsage, error) {
+	metrics := p.db.Metrics()
+	return DiskUsage{
+		Total:  int64(metrics.DiskSpaceUsage()),
+		Tables: metrics.Total().Size,
+		WAL:    int64(metrics.WAL.PhysicalSize),
+	}, nil
+}
+
 // Close closes the database
 func (p *PebbleDB) Close() error {
 	return p.db.Close()
@@ -60,7 +206,7 @@ func (p *PebbleDB) Close() error {
 
 // PebbleTransaction implements the Transaction interface for Pebble
 type PebbleTransaction struct {
-	db    *pebble.DB
+	db    *PebbleDB
 	batch *pebble.Batch
 }
 
@@ -69,9 +215,18 @@ func (t *PebbleTransaction) Set(key []byte, value []byte) error {
 	return t.batch.Set(key, value, nil)
 }
 
-// Commit commits the transaction
+// Delete removes a key within a transaction
+func (t *PebbleTransaction) Delete(key []byte) error {
+	return t.batch.Delete(key, nil)
+}
+
+// Commit commits the transaction, syncing it if the durability mode requires it.
+// Syncing the WAL also persists every unsynced batch committed before it.
 func (t *PebbleTransaction) Commit() error {
-	return t.batch.Commit(pebble.Sync)
+	if t.db.policy.next() {
+		return t.batch.Commit(pebble.Sync)
+	}
+	return t.batch.Commit(pebble.NoSync)
 }
 
 // Rollback aborts the transaction
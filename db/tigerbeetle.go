@@ -3,31 +3,76 @@
 package db
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"math/big"
+	"sort"
 	"strconv"
 
 	tb "github.com/tigerbeetle/tigerbeetle-go"
 	"github.com/tigerbeetle/tigerbeetle-go/pkg/types"
 )
 
-// TigerBeetleDB implements the DB interface using TigerBeetle
+// Ledger and code used for every account and transfer created by the app.
+// TigerBeetle rejects zero values for both.
+const (
+	tbLedger = 1
+	tbCode   = 1
+)
+
+// Transfer kinds, stored in the high 64 bits of TigerBeetle transfer ids so that
+// the post or void of a pending transfer never collides with its creation.
+const (
+	tbTransferPending = 1
+	tbTransferPost    = 2
+	tbTransferVoid    = 3
+)
+
+// tbBatchSize is the number of accounts or transfers sent per request, below
+// TigerBeetle's limit of 8189
+const tbBatchSize = 8000
+
+// tbOperatorID is the account funding the transfers that bring account
+// balances to the values the app sets. Its id is above the 64-bit account ids
+// of the app.
+var tbOperatorID = types.BytesToUint128([16]byte{8: 1})
+
+// TigerBeetleDB implements the DB interface using TigerBeetle for account
+// balances and pending transfers. Every key, balances included, is also kept
+// in a local Pebble store, which reads are served from, so that the app state
+// and block metadata survive restarts.
 type TigerBeetleDB struct {
 	client tb.Client
+	store  *PebbleDB
 }
 
-// NewTigerBeetleDB creates a new TigerBeetleDB instance
-func NewTigerBeetleDB(addresses []string) (DB, error) {
+// NewTigerBeetleDB creates a new TigerBeetleDB instance keeping its local
+// store at path
+func NewTigerBeetleDB(addresses []string, path string, opts PebbleOptions) (DB, error) {
+	store, err := openPebbleDB(path, opts)
+	if err != nil {
+		return nil, fmt.Errorf("opening local store: %w", err)
+	}
+
 	// Convert clusterID to Uint128
 	clusterIDUint128 := types.ToUint128(0)
 
 	client, err := tb.NewClient(clusterIDUint128, addresses)
 	if err != nil {
+		store.Close()
 		return nil, err
 	}
 
-	return &TigerBeetleDB{
+	t := &TigerBeetleDB{
 		client: client,
-	}, nil
+		store:  store,
+	}
+	if err := t.createAccounts([]types.Uint128{tbOperatorID}); err != nil {
+		t.Close()
+		return nil, fmt.Errorf("creating operator account: %w", err)
+	}
+	return t, nil
 }
 
 // isAccountKey determines if a key represents an account
@@ -43,135 +88,329 @@ func parseAccountID(key []byte) types.Uint128 {
 	return types.ToUint128(id)
 }
 
-// parseBalance converts a byte slice to a balance
-func parseBalance(value []byte) uint64 {
-	if value == nil {
-		return 0
+// parseTransferID converts a pending transfer id to a TigerBeetle transfer ID
+// of the given kind. Ids must be canonical so that distinct ids never map to
+// the same transfer.
+func parseTransferID(id []byte, kind uint64) (types.Uint128, error) {
+	n, err := strconv.ParseUint(string(id), 10, 64)
+	if err != nil || strconv.FormatUint(n, 10) != string(id) {
+		return types.Uint128{}, fmt.Errorf("invalid pending transfer id %q", id)
 	}
-	balance, _ := strconv.ParseUint(string(value), 10, 64)
-	return balance
+	var b [16]byte
+	binary.LittleEndian.PutUint64(b[:8], n)
+	binary.LittleEndian.PutUint64(b[8:], kind)
+	return types.BytesToUint128(b), nil
 }
 
-// encodeBalance converts a balance to a byte slice
-func encodeBalance(balance uint64) []byte {
-	return []byte(strconv.FormatUint(balance, 10))
+// toTBUint128 converts an amount to a TigerBeetle Uint128
+func toTBUint128(v Uint128) types.Uint128 {
+	var b [16]byte
+	binary.LittleEndian.PutUint64(b[:8], v.Lo)
+	binary.LittleEndian.PutUint64(b[8:], v.Hi)
+	return types.BytesToUint128(b)
 }
 
-// getAccountBalance calculates the balance from an account
-func getAccountBalance(account types.Account) uint64 {
-	// In TigerBeetle, we'll use UserData64 to store the balance
-	return account.UserData64
+// accountBalance returns the balance of an account: its initial balance in
+// UserData64, adjusted by the transfers applied to it
+func accountBalance(account types.Account) *big.Int {
+	balance := new(big.Int).SetUint64(account.UserData64)
+	for _, v := range []types.Uint128{account.DebitsPosted, account.DebitsPending} {
+		amount := v.BigInt()
+		balance.Sub(balance, &amount)
+	}
+	credits := account.CreditsPosted.BigInt()
+	return balance.Add(balance, &credits)
 }
 
-// Get retrieves a value for the given key
-func (t *TigerBeetleDB) Get(key []byte) ([]byte, error) {
-	if isAccountKey(key) {
-		accountID := parseAccountID(key)
-		accounts, err := t.client.LookupAccounts([]types.Uint128{accountID})
+// createAccounts creates the accounts that don't exist yet
+func (t *TigerBeetleDB) createAccounts(ids []types.Uint128) error {
+	for start := 0; start < len(ids); start += tbBatchSize {
+		batch := ids[start:min(start+tbBatchSize, len(ids))]
+		accounts := make([]types.Account, len(batch))
+		for i, id := range batch {
+			accounts[i] = types.Account{ID: id, Ledger: tbLedger, Code: tbCode}
+		}
+		results, err := t.client.CreateAccounts(accounts)
 		if err != nil {
-			return nil, err
+			return err
 		}
-
-		if len(accounts) == 0 {
-			return nil, ErrKeyNotFound
+		for _, res := range results {
+			if res.Result != types.AccountOK && res.Result != types.AccountExists {
+				return fmt.Errorf("failed to create account %s: %v", accounts[res.Index].ID, res.Result)
+			}
 		}
-
-		balance := getAccountBalance(accounts[0])
-		return encodeBalance(balance), nil
 	}
+	return nil
+}
 
-	return nil, ErrKeyNotFound
+// createTransfers submits transfers in order. Transfers already created
+// before a crash are replayed by CometBFT and accepted.
+func (t *TigerBeetleDB) createTransfers(transfers []types.Transfer) error {
+	for start := 0; start < len(transfers); start += tbBatchSize {
+		results, err := t.client.CreateTransfers(transfers[start:min(start+tbBatchSize, len(transfers))])
+		if err != nil {
+			return err
+		}
+		for _, res := range results {
+			if res.Result != types.TransferOK && res.Result != types.TransferExists {
+				return fmt.Errorf("failed to create transfer %d: %v", start+int(res.Index), res.Result)
+			}
+		}
+	}
+	return nil
 }
 
-// Set stores a key-value pair
-func (t *TigerBeetleDB) Set(key []byte, value []byte) error {
-	if isAccountKey(key) {
-		accountID := parseAccountID(key)
-		balance := parseBalance(value)
+// setBalances brings the balance of each account to the value in balances,
+// by account key, with transfers from or to the operator account. Balances
+// are set after the pending transfers of the block, which they account for.
+func (t *TigerBeetleDB) setBalances(balances map[string][]byte) error {
+	keys := make([]string, 0, len(balances))
+	for key := range balances {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 
-		// First try to look up the account
-		accounts, err := t.client.LookupAccounts([]types.Uint128{accountID})
+	var transfers []types.Transfer
+	for start := 0; start < len(keys); start += tbBatchSize {
+		batch := keys[start:min(start+tbBatchSize, len(keys))]
+		ids := make([]types.Uint128, len(batch))
+		for i, key := range batch {
+			ids[i] = parseAccountID([]byte(key))
+		}
+		accounts, err := t.client.LookupAccounts(ids)
 		if err != nil {
 			return err
 		}
+		current := make(map[types.Uint128]*big.Int, len(accounts))
+		for _, account := range accounts {
+			current[account.ID] = accountBalance(account)
+		}
 
-		if len(accounts) > 0 {
-			// Account exists, but TigerBeetle doesn't support direct updates
-			// For now, we'll just verify the balance matches what we expect
-			// In a real implementation, you'd use transfers to adjust balances
-			if accounts[0].UserData64 != balance {
-				// Log a warning that balance doesn't match
-				fmt.Printf("Warning: Account %s balance mismatch: %d vs %d\n",
-					string(key), accounts[0].UserData64, balance)
+		for i, key := range batch {
+			balance, ok := current[ids[i]]
+			if !ok {
+				return fmt.Errorf("account %s doesn't exist", key)
 			}
-			return nil
-		} else {
-			// Account doesn't exist, create it
-			account := types.Account{
-				ID:         accountID,
-				UserData64: balance, // Store balance in UserData64
-				// Set other fields as needed
+			target, ok := new(big.Int).SetString(string(balances[key]), 10)
+			if !ok || target.Sign() < 0 {
+				return fmt.Errorf("invalid balance %q of account %s", balances[key], key)
 			}
-
-			result, err := t.client.CreateAccounts([]types.Account{account})
-			if err != nil {
-				return err
+			delta := target.Sub(target, balance)
+			transfer := types.Transfer{
+				ID:              types.ID(),
+				DebitAccountID:  tbOperatorID,
+				CreditAccountID: ids[i],
+				Ledger:          tbLedger,
+				Code:            tbCode,
 			}
-
-			if len(result) > 0 && result[0].Result != types.AccountOK && result[0].Result != types.AccountExists {
-				return fmt.Errorf("failed to create account: %v", result[0].Result)
+			switch delta.Sign() {
+			case 0:
+				continue
+			case -1:
+				transfer.DebitAccountID, transfer.CreditAccountID = ids[i], tbOperatorID
+				delta.Neg(delta)
 			}
+			transfer.Amount = types.BigIntToUint128(*delta)
+			transfers = append(transfers, transfer)
 		}
+	}
+	return t.createTransfers(transfers)
+}
 
-		return nil
+// Get retrieves a value for the given key from the local store
+func (t *TigerBeetleDB) Get(key []byte) ([]byte, error) {
+	return t.store.Get(key)
+}
+
+// Set stores a key-value pair, outside of any block
+func (t *TigerBeetleDB) Set(key []byte, value []byte) error {
+	tx, err := t.BeginTx()
+	if err != nil {
+		return err
+	}
+	if err := tx.Set(key, value); err != nil {
+		tx.Rollback()
+		return err
 	}
+	return tx.Commit()
+}
 
-	// return error if key is not an account
-	return fmt.Errorf("unsupported key: %s", key)
+// Iterate calls fn for every key starting with prefix, in key order, from the
+// local store
+func (t *TigerBeetleDB) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	return t.store.Iterate(prefix, fn)
 }
 
 // BeginTx starts a new transaction
 func (t *TigerBeetleDB) BeginTx() (Transaction, error) {
+	store, err := t.store.BeginTx()
+	if err != nil {
+		return nil, err
+	}
 	return &TigerBeetleTransaction{
-		db:            t,
-		pendingWrites: make(map[string][]byte),
+		db:       t,
+		store:    store,
+		balances: make(map[string][]byte),
 	}, nil
 }
 
+var _ Maintainer = (*TigerBeetleDB)(nil)
+
+// RunMaintenance compacts the local store
+func (t *TigerBeetleDB) RunMaintenance() error {
+	return t.store.RunMaintenance()
+}
+
+// DiskUsage returns the size of the local store
+func (t *TigerBeetleDB) DiskUsage() (DiskUsage, error) {
+	return t.store.DiskUsage()
+}
+
 // Close closes the database
 func (t *TigerBeetleDB) Close() error {
 	t.client.Close()
-	return nil
+	return t.store.Close()
 }
 
+var _ PendingTransfers = (*TigerBeetleTransaction)(nil)
+
 // TigerBeetleTransaction implements the Transaction interface for TigerBeetle
 type TigerBeetleTransaction struct {
-	db            *TigerBeetleDB
-	pendingWrites map[string][]byte
+	db    *TigerBeetleDB
+	store Transaction
+	// balances holds the account balances written, by account key
+	balances  map[string][]byte
+	transfers []types.Transfer
 }
 
 // Set stores a key-value pair within a transaction
 func (t *TigerBeetleTransaction) Set(key []byte, value []byte) error {
-	// Track the write
-	t.pendingWrites[string(key)] = value
-	return nil
+	if isAccountKey(key) {
+		t.balances[string(key)] = value
+	}
+	return t.store.Set(key, value)
 }
 
-// Commit commits the transaction
+// Delete removes a key within a transaction. Accounts can't be deleted.
+func (t *TigerBeetleTransaction) Delete(key []byte) error {
+	if isAccountKey(key) {
+		return fmt.Errorf("account %s can't be deleted", key)
+	}
+	return t.store.Delete(key)
+}
+
+// Commit applies the transaction to TigerBeetle, then commits it to the local
+// store. A block lost from the local store in a crash is replayed by CometBFT,
+// and replaying it on TigerBeetle leaves the same balances.
 func (t *TigerBeetleTransaction) Commit() error {
-	// First, create any accounts
-	for key, value := range t.pendingWrites {
-		t.db.Set([]byte(key), value)
+	// First, create any accounts, so that the transfers can move funds
+	ids := make([]types.Uint128, 0, len(t.balances))
+	for key := range t.balances {
+		ids = append(ids, parseAccountID([]byte(key)))
+	}
+	if err := t.db.createAccounts(ids); err != nil {
+		return err
+	}
+
+	// Then submit the transfers, in order, and set the balances on top of them
+	if err := t.db.createTransfers(t.transfers); err != nil {
+		return err
+	}
+	if err := t.db.setBalances(t.balances); err != nil {
+		return err
 	}
+	t.balances = make(map[string][]byte)
+	t.transfers = nil
+	return t.store.Commit()
+}
 
-	// Clear the pending writes
-	t.pendingWrites = make(map[string][]byte)
+// CreatePending queues a pending transfer reserving amount on the debit account
+func (t *TigerBeetleTransaction) CreatePending(id, debit, credit []byte, amount Uint128, timeout uint32) error {
+	transferID, err := parseTransferID(id, tbTransferPending)
+	if err != nil {
+		return err
+	}
+	// The transfer moves the TigerBeetle balances of both accounts, which are
+	// set back to the stored ones unless the transaction writes them
+	for _, key := range [][]byte{debit, credit} {
+		if err := t.trackBalance(key); err != nil {
+			return err
+		}
+	}
+	t.transfers = append(t.transfers, types.Transfer{
+		ID:              transferID,
+		DebitAccountID:  parseAccountID(debit),
+		CreditAccountID: parseAccountID(credit),
+		Amount:          toTBUint128(amount),
+		Timeout:         timeout,
+		Ledger:          tbLedger,
+		Code:            tbCode,
+		Flags:           types.TransferFlags{Pending: true}.ToUint16(),
+	})
+	return nil
+}
+
+// trackBalance adds the stored balance of an account to the balances set on
+// commit, if the transaction hasn't written it
+func (t *TigerBeetleTransaction) trackBalance(key []byte) error {
+	if _, ok := t.balances[string(key)]; ok {
+		return nil
+	}
+	value, err := t.db.store.Get(key)
+	if errors.Is(err, ErrKeyNotFound) {
+		value = []byte("0")
+	} else if err != nil {
+		return err
+	}
+	t.balances[string(key)] = value
+	return nil
+}
+
+// PostPending queues the posting of amount of a pending transfer
+func (t *TigerBeetleTransaction) PostPending(id []byte, amount Uint128) error {
+	transferID, err := parseTransferID(id, tbTransferPost)
+	if err != nil {
+		return err
+	}
+	pendingID, err := parseTransferID(id, tbTransferPending)
+	if err != nil {
+		return err
+	}
+	t.transfers = append(t.transfers, types.Transfer{
+		ID:        transferID,
+		PendingID: pendingID,
+		Amount:    toTBUint128(amount),
+		Ledger:    tbLedger,
+		Code:      tbCode,
+		Flags:     types.TransferFlags{PostPendingTransfer: true}.ToUint16(),
+	})
+	return nil
+}
+
+// VoidPending queues the voiding of a pending transfer
+func (t *TigerBeetleTransaction) VoidPending(id []byte) error {
+	transferID, err := parseTransferID(id, tbTransferVoid)
+	if err != nil {
+		return err
+	}
+	pendingID, err := parseTransferID(id, tbTransferPending)
+	if err != nil {
+		return err
+	}
+	t.transfers = append(t.transfers, types.Transfer{
+		ID:        transferID,
+		PendingID: pendingID,
+		Ledger:    tbLedger,
+		Code:      tbCode,
+		Flags:     types.TransferFlags{VoidPendingTransfer: true}.ToUint16(),
+	})
 	return nil
 }
 
 // Rollback aborts the transaction
 func (t *TigerBeetleTransaction) Rollback() error {
 	// Just discard the pending changes
-	t.pendingWrites = make(map[string][]byte)
-	return nil
+	t.balances = make(map[string][]byte)
+	t.transfers = nil
+	return t.store.Rollback()
 }
@@ -7,6 +7,6 @@ import (
 )
 
 // NewTigerBeetleDBFromMain is a stub function for non-TigerBeetle builds
-func NewTigerBeetleDBFromMain(addresses string) (DB, error) {
+func NewTigerBeetleDBFromMain(addresses string, path string, opts PebbleOptions) (DB, error) {
 	return nil, fmt.Errorf("TigerBeetle support requires building with -tags tigerbeetle")
 }
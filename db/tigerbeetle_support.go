@@ -10,10 +10,11 @@ import (
 	"github.com/tigerbeetle/tigerbeetle-go/pkg/types"
 )
 
-// NewTigerBeetleDBFromMain creates a new TigerBeetleDB instance from a comma-separated list of addresses
-func NewTigerBeetleDBFromMain(addresses string) (DB, error) {
+// NewTigerBeetleDBFromMain creates a new TigerBeetleDB instance from a comma-separated list of addresses,
+// keeping its local store at path
+func NewTigerBeetleDBFromMain(addresses string, path string, opts PebbleOptions) (DB, error) {
 	addressList := strings.Split(addresses, ",")
-	return NewTigerBeetleDB(addressList)
+	return NewTigerBeetleDB(addressList, path, opts)
 }
 
 // InitializeTigerBeetleAccounts pre-creates accounts in TigerBeetle
@@ -33,7 +34,8 @@ func InitializeTigerBeetleAccounts(db DB, accountIDs []string, initialBalances m
 		account := types.Account{
 			ID:         accountID,
 			UserData64: balance,
-			// Set other fields as needed
+			Ledger:     tbLedger,
+			Code:       tbCode,
 		}
 
 		accounts = append(accounts, account)
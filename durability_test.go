@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"test/db"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+// crashChildEnv holds the backend, path and durability options of the node
+// run by TestDurabilityCrashChild, which is killed after committing its blocks
+const crashChildEnv = "DURABILITY_CRASH_CHILD"
+
+// crashBlocks is the number of blocks the child commits before being killed
+const crashBlocks = 7
+
+// openCrashDB opens backend at dir with the default options and the given
+// durability options
+func openCrashDB(backend, dir string, opts db.DurabilityOptions) (db.DB, error) {
+	switch backend {
+	case "badger":
+		return db.NewBadgerDB(dir, db.BadgerOptions{DurabilityOptions: opts})
+	case "pebble":
+		return db.NewPebbleDB(dir, db.PebbleOptions{LogLevel: "error", DurabilityOptions: opts})
+	}
+	return nil, fmt.Errorf("unknown backend %s", backend)
+}
+
+// crashBlock returns block height, which transfers 1 from account 1 to 2
+func crashBlock(height int64) *abcitypes.FinalizeBlockRequest {
+	return &abcitypes.FinalizeBlockRequest{
+		Height: height,
+		Txs:    [][]byte{transferTx(strconv.FormatInt(height, 10), "1", "2", "1", "")},
+		Time:   time.Unix(1_700_000_000+height, 0),
+	}
+}
+
+// TestDurabilityCrashChild runs a node that commits crashBlocks blocks and is
+// killed before it can close its database. It only runs as a child process of
+// TestDurabilityAfterCrash.
+func TestDurabilityCrashChild(t *testing.T) {
+	config := os.Getenv(crashChildEnv)
+	if config == "" {
+		t.Skip("only runs as a child of TestDurabilityAfterCrash")
+	}
+	var backend, dir string
+	var opts db.DurabilityOptions
+	if _, err := fmt.Sscan(config, &backend, &dir, &opts.Durability, &opts.SyncEvery); err != nil {
+		t.Fatalf("invalid %s: %v", crashChildEnv, err)
+	}
+
+	database, err := openCrashDB(backend, dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err := NewKVStoreApplication(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.InitChain(context.Background(), testGenesis(t)); err != nil {
+		t.Fatal(err)
+	}
+	for height := int64(1); height <= crashBlocks; height++ {
+		commitBlock(t, app, crashBlock(height))
+	}
+
+	// Writes that were not synced are lost unless the OS flushed them
+	fmt.Printf("committed %d blocks\n", crashBlocks)
+	process, _ := os.FindProcess(os.Getpid())
+	process.Kill()
+	select {}
+}
+
+func TestDurabilityAfterCrash(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs child processes")
+	}
+	modes := []struct {
+		opts db.DurabilityOptions
+		// synced is the number of blocks that must survive a crash
+		synced int64
+	}{
+		{db.DurabilityOptions{Durability: db.DurabilitySync}, crashBlocks},
+		// The genesis commit is the first of the group, block 5 the last
+		// one synced
+		{db.DurabilityOptions{Durability: db.DurabilityGroup, SyncEvery: 3}, 5},
+		{db.DurabilityOptions{Durability: db.DurabilityNone}, 0},
+	}
+	for _, backend := range []string{"badger", "pebble"} {
+		for _, mode := range modes {
+			t.Run(fmt.Sprintf("%s/%s", backend, mode.opts.Durability), func(t *testing.T) {
+				dir := t.TempDir()
+				child := exec.Command(os.Args[0], "-test.run=^TestDurabilityCrashChild$", "-test.v")
+				child.Env = append(os.Environ(), fmt.Sprintf("%s=%s %s %s %d",
+					crashChildEnv, backend, dir, mode.opts.Durability, mode.opts.SyncEvery))
+				out, err := child.CombinedOutput()
+				if err == nil || !bytes.Contains(out, []byte(fmt.Sprintf("committed %d blocks", crashBlocks))) {
+					t.Fatalf("child was not killed after committing its blocks: %v\n%s", err, out)
+				}
+
+				database, err := openCrashDB(backend, dir, mode.opts)
+				if err != nil {
+					t.Fatalf("reopening after a crash: %v", err)
+				}
+				defer database.Close()
+				app, err := NewKVStoreApplication(database)
+				if err != nil {
+					t.Fatalf("recovering after a crash: %v", err)
+				}
+				info, err := app.Info(context.Background(), &abcitypes.InfoRequest{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				height := info.LastBlockHeight
+				if height < mode.synced || height > crashBlocks {
+					t.Fatalf("recovered at height %d, want between %d and %d", height, mode.synced, crashBlocks)
+				}
+
+				// Nothing survived, CometBFT starts over from genesis
+				if height == 0 {
+					if _, err := app.InitChain(context.Background(), testGenesis(t)); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				// The state is the one left by the reported block, so that
+				// CometBFT can replay the lost ones on top of it
+				if height > 0 && !bytes.Equal(info.LastBlockAppHash, appHash()) {
+					t.Fatalf("app hash %X does not match the recovered state %X", info.LastBlockAppHash, appHash())
+				}
+				if got, want := balanceOf(nativeDenom(), "2"), NewAmount(1000+uint64(height)); got != want {
+					t.Fatalf("balance of account 2 is %s at height %d, want %s", got, height, want)
+				}
+				for h := height + 1; h <= crashBlocks; h++ {
+					commitBlock(t, app, crashBlock(h))
+				}
+			})
+		}
+	}
+}
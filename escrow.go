@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"test/apperrors"
+	"test/db"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+// Pending transfer lifecycle states.
+const (
+	pendingStatusPending = "pending"
+	pendingStatusPosted  = "posted"
+	pendingStatusVoided  = "voided"
+	pendingStatusExpired = "expired"
+)
+
+// PendingTransfer reserves Amount of the sender's native balance for Dest. The
+// hold is settled by a PostPendingTransfer, released by a VoidPendingTransfer,
+// or released automatically once Timeout seconds (0 means never) have elapsed
+// since the block that created it.
+type PendingTransfer struct {
+	Id        string `json:"id"`
+	Sender    string `json:"sender"`
+	Dest      string `json:"dest"`
+	Amount    string `json:"amount"`
+	Timeout   string `json:"timeout"`
+	Signature string `json:"signature"`
+}
+
+// PostPendingTransfer settles Amount (at most the reserved amount) of a pending
+// transfer to its destination and releases the remainder back to the sender.
+// It must be signed by the pending transfer's destination.
+type PostPendingTransfer struct {
+	PendingId string `json:"pending_id"`
+	Dest      string `json:"dest"`
+	Amount    string `json:"amount"`
+	Signature string `json:"signature"`
+}
+
+// VoidPendingTransfer releases a pending transfer back to its sender. It must
+// be signed by the pending transfer's destination.
+type VoidPendingTransfer struct {
+	PendingId string `json:"pending_id"`
+	Dest      string `json:"dest"`
+	Signature string `json:"signature"`
+}
+
+// pendingRecord is the stored state of a pending transfer. Records are kept
+// after they are settled so that ids are never reused.
+type pendingRecord struct {
+	Sender    string `json:"sender"`
+	Dest      string `json:"dest"`
+	Amount    Amount `json:"amount"`
+	ExpiresAt int64  `json:"expires_at"`
+	Status    string `json:"status"`
+}
+
+var pendingMap = map[string]*pendingRecord{}
+
+// reservedMap holds the total amount of each account locked in pending transfers.
+var reservedMap = map[string]Amount{}
+
+// parsePendingTransfer decodes pending=id=sender=dest=amount=timeout=signature.
+func parsePendingTransfer(parts [][]byte) Msg {
+	if len(parts) != 7 {
+		return nil
+	}
+	return &PendingTransfer{
+		Id:        string(parts[1]),
+		Sender:    string(parts[2]),
+		Dest:      string(parts[3]),
+		Amount:    string(parts[4]),
+		Timeout:   string(parts[5]),
+		Signature: string(parts[6]),
+	}
+}
+
+// parsePostPendingTransfer decodes post=pending_id=dest=amount=signature.
+func parsePostPendingTransfer(parts [][]byte) Msg {
+	if len(parts) != 5 {
+		return nil
+	}
+	return &PostPendingTransfer{
+		PendingId: string(parts[1]),
+		Dest:      string(parts[2]),
+		Amount:    string(parts[3]),
+		Signature: string(parts[4]),
+	}
+}
+
+// parseVoidPendingTransfer decodes void=pending_id=dest=signature.
+func parseVoidPendingTransfer(parts [][]byte) Msg {
+	if len(parts) != 4 {
+		return nil
+	}
+	return &VoidPendingTransfer{
+		PendingId: string(parts[1]),
+		Dest:      string(parts[2]),
+		Signature: string(parts[3]),
+	}
+}
+
+func (p *PendingTransfer) Signer() string { return p.Sender }
+
+func (p *PendingTransfer) Sig() string { return p.Signature }
+
+func (p *PendingTransfer) Challenge() []byte {
+	return []byte(strings.Join([]string{"pending", p.Id, p.Sender, p.Dest, p.Amount, p.Timeout}, "="))
+}
+
+func (p *PostPendingTransfer) Signer() string { return p.Dest }
+
+func (p *PostPendingTransfer) Sig() string { return p.Signature }
+
+func (p *PostPendingTransfer) Challenge() []byte {
+	return []byte(strings.Join([]string{"post", p.PendingId, p.Dest, p.Amount}, "="))
+}
+
+func (v *VoidPendingTransfer) Signer() string { return v.Dest }
+
+func (v *VoidPendingTransfer) Sig() string { return v.Signature }
+
+func (v *VoidPendingTransfer) Challenge() []byte {
+	return []byte(strings.Join([]string{"void", v.PendingId, v.Dest}, "="))
+}
+
+func isValidPendingTransfer(p *PendingTransfer, ctx *txContext) error {
+	if _, ok := keyMap[p.Dest]; !ok {
+		return apperrors.ErrUnknownRecipient.Wrapf("%q", p.Dest)
+	}
+	// Ids must be canonical numbers so they map onto distinct TigerBeetle
+	// transfer ids
+	if id, err := strconv.ParseUint(p.Id, 10, 64); err != nil || strconv.FormatUint(id, 10) != p.Id {
+		return apperrors.ErrInvalidPendingTransfer.Wrapf("id %q", p.Id)
+	}
+	if _, ok := pendingMap[p.Id]; ok || ctx.pendingIds[p.Id] {
+		return apperrors.ErrPendingTransferExists.Wrapf("%s", p.Id)
+	}
+	amount, err := ParsePositiveAmount(p.Amount, params.Decimals)
+	if err != nil {
+		return apperrors.ErrInvalidAmount.Wrapf("%q: %v", p.Amount, err)
+	}
+	timeout, err := strconv.ParseUint(p.Timeout, 10, 32)
+	if err != nil || strconv.FormatUint(timeout, 10) != p.Timeout {
+		return apperrors.ErrInvalidPendingTransfer.Wrapf("timeout %q", p.Timeout)
+	}
+	if err := ctx.debit(nativeDenom(), p.Sender, amount); err != nil {
+		return err
+	}
+	ctx.pendingIds[p.Id] = true
+	return nil
+}
+
+func isValidPostPendingTransfer(p *PostPendingTransfer, ctx *txContext) error {
+	record, ok := pendingMap[p.PendingId]
+	if !ok || record.Status != pendingStatusPending || ctx.pendingIds[p.PendingId] {
+		return apperrors.ErrPendingTransferClosed.Wrapf("%s", p.PendingId)
+	}
+	if record.Dest != p.Dest {
+		return apperrors.ErrNotPendingRecipient.Wrapf("%s is not the recipient of %s", p.Dest, p.PendingId)
+	}
+	amount, err := ParsePositiveAmount(p.Amount, params.Decimals)
+	if err != nil {
+		return apperrors.ErrInvalidAmount.Wrapf("%q: %v", p.Amount, err)
+	}
+	if amount.Cmp(record.Amount) > 0 {
+		return apperrors.ErrPostExceedsPending.Wrapf("posting %s of %s", amount, record.Amount)
+	}
+	ctx.pendingIds[p.PendingId] = true
+	return nil
+}
+
+func isValidVoidPendingTransfer(v *VoidPendingTransfer, ctx *txContext) error {
+	record, ok := pendingMap[v.PendingId]
+	if !ok || record.Status != pendingStatusPending || ctx.pendingIds[v.PendingId] {
+		return apperrors.ErrPendingTransferClosed.Wrapf("%s", v.PendingId)
+	}
+	if record.Dest != v.Dest {
+		return apperrors.ErrNotPendingRecipient.Wrapf("%s is not the recipient of %s", v.Dest, v.PendingId)
+	}
+	ctx.pendingIds[v.PendingId] = true
+	return nil
+}
+
+// nativeLedger returns the ongoing block's transaction as a db.PendingTransfers
+// if the backend supports two-phase transfers natively.
+func (app *KVStoreApplication) nativeLedger() (db.PendingTransfers, bool) {
+	ledger, ok := app.onGoingBlock.(db.PendingTransfers)
+	return ledger, ok
+}
+
+// createNativePending creates the pending transfer id on a backend that
+// supports two-phase transfers natively. The app expires the transfer by block
+// time, TigerBeetle's own clock would void it behind the app's back.
+func createNativePending(ledger db.PendingTransfers, id string, record *pendingRecord) error {
+	if err := ledger.CreatePending([]byte(id), []byte(record.Sender), []byte(record.Dest), record.Amount.ledgerAmount(), 0); err != nil {
+		return fmt.Errorf("creating pending transfer %s: %w", id, err)
+	}
+	return nil
+}
+
+// openPendingRecord returns the pending transfer id, which isValid checked is
+// still pending
+func openPendingRecord(id string) (*pendingRecord, error) {
+	record, ok := pendingMap[id]
+	if !ok || record.Status != pendingStatusPending {
+		return nil, apperrors.ErrPendingTransferClosed.Wrapf("%s", id)
+	}
+	return record, nil
+}
+
+func (app *KVStoreApplication) executePendingTransfer(p *PendingTransfer, blockTime time.Time) (abcitypes.Event, error) {
+	amount, err := parseAmount(p.Amount, params.Decimals)
+	if err != nil {
+		return abcitypes.Event{}, err
+	}
+	timeout, err := strconv.ParseUint(p.Timeout, 10, 32)
+	if err != nil {
+		return abcitypes.Event{}, apperrors.ErrInvalidPendingTransfer.Wrapf("timeout %q", p.Timeout)
+	}
+
+	record := &pendingRecord{
+		Sender: p.Sender,
+		Dest:   p.Dest,
+		Amount: amount,
+		Status: pendingStatusPending,
+	}
+	if timeout > 0 {
+		record.ExpiresAt = blockTime.Unix() + int64(timeout)
+	}
+
+	if ledger, ok := app.nativeLedger(); ok {
+		if err := createNativePending(ledger, p.Id, record); err != nil {
+			return abcitypes.Event{}, err
+		}
+	}
+	if err := app.debit(nativeDenom(), p.Sender, amount); err != nil {
+		return abcitypes.Event{}, err
+	}
+	reserved, err := reservedMap[p.Sender].Add(amount)
+	if err != nil {
+		return abcitypes.Event{}, apperrors.ErrSupplyOverflow.Wrapf("reserved amount of account %s", p.Sender)
+	}
+	if err := app.setReserved(p.Sender, reserved); err != nil {
+		return abcitypes.Event{}, err
+	}
+	if err := app.setPending(p.Id, record); err != nil {
+		return abcitypes.Event{}, err
+	}
+
+	return pendingEvent("pending_created", p.Id, record, amount), nil
+}
+
+func (app *KVStoreApplication) executePostPendingTransfer(p *PostPendingTransfer) (abcitypes.Event, error) {
+	record, err := openPendingRecord(p.PendingId)
+	if err != nil {
+		return abcitypes.Event{}, err
+	}
+	amount, err := parseAmount(p.Amount, params.Decimals)
+	if err != nil {
+		return abcitypes.Event{}, err
+	}
+	remainder, err := record.Amount.Sub(amount)
+	if err != nil {
+		return abcitypes.Event{}, apperrors.ErrPostExceedsPending.Wrapf("posting %s of %s", amount, record.Amount)
+	}
+
+	if ledger, ok := app.nativeLedger(); ok {
+		if err := ledger.PostPending([]byte(p.PendingId), amount.ledgerAmount()); err != nil {
+			return abcitypes.Event{}, fmt.Errorf("posting pending transfer %s: %w", p.PendingId, err)
+		}
+	}
+	posted, err := app.settlePending(p.PendingId, record, pendingStatusPosted)
+	if err != nil {
+		return abcitypes.Event{}, err
+	}
+	denom := nativeDenom()
+	if err := app.credit(denom, record.Sender, remainder); err != nil {
+		return abcitypes.Event{}, err
+	}
+	if err := app.credit(denom, record.Dest, amount); err != nil {
+		return abcitypes.Event{}, err
+	}
+
+	return pendingEvent("pending_posted", p.PendingId, posted, amount), nil
+}
+
+func (app *KVStoreApplication) executeVoidPendingTransfer(v *VoidPendingTransfer) (abcitypes.Event, error) {
+	record, err := openPendingRecord(v.PendingId)
+	if err != nil {
+		return abcitypes.Event{}, err
+	}
+
+	if ledger, ok := app.nativeLedger(); ok {
+		if err := ledger.VoidPending([]byte(v.PendingId)); err != nil {
+			return abcitypes.Event{}, fmt.Errorf("voiding pending transfer %s: %w", v.PendingId, err)
+		}
+	}
+	voided, err := app.releasePending(v.PendingId, record, pendingStatusVoided)
+	if err != nil {
+		return abcitypes.Event{}, err
+	}
+
+	return pendingEvent("pending_voided", v.PendingId, voided, voided.Amount), nil
+}
+
+// expirePendingTransfers releases every pending transfer whose timeout has
+// elapsed at blockTime, voiding it on backends with native pending transfers
+func (app *KVStoreApplication) expirePendingTransfers(blockTime time.Time) ([]abcitypes.Event, error) {
+	ids := make([]string, 0, len(pendingMap))
+	for id, record := range pendingMap {
+		if record.Status == pendingStatusPending && record.ExpiresAt != 0 && record.ExpiresAt <= blockTime.Unix() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	events := make([]abcitypes.Event, 0, len(ids))
+	for _, id := range ids {
+		if ledger, ok := app.nativeLedger(); ok {
+			if err := ledger.VoidPending([]byte(id)); err != nil {
+				return nil, fmt.Errorf("voiding pending transfer %s: %w", id, err)
+			}
+		}
+		expired, err := app.releasePending(id, pendingMap[id], pendingStatusExpired)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, pendingEvent("pending_expired", id, expired, expired.Amount))
+	}
+	return events, nil
+}
+
+// settlePending closes a pending transfer with status and takes its amount out
+// of the sender's reserved balance, returning the updated record
+func (app *KVStoreApplication) settlePending(id string, record *pendingRecord, status string) (*pendingRecord, error) {
+	reserved, err := reservedMap[record.Sender].Sub(record.Amount)
+	if err != nil {
+		return nil, fmt.Errorf("reserved amount of account %s is below pending transfer %s: %w", record.Sender, id, err)
+	}
+	if err := app.setReserved(record.Sender, reserved); err != nil {
+		return nil, err
+	}
+	// Records are replaced rather than updated so that a reverted
+	// transaction leaves them untouched
+	settled := *record
+	settled.Status = status
+	return &settled, app.setPending(id, &settled)
+}
+
+// releasePending returns the reserved amount of a pending transfer to its sender.
+func (app *KVStoreApplication) releasePending(id string, record *pendingRecord, status string) (*pendingRecord, error) {
+	released, err := app.settlePending(id, record, status)
+	if err != nil {
+		return nil, err
+	}
+	return released, app.credit(nativeDenom(), record.Sender, record.Amount)
+}
+
+// setReserved updates the reserved balance of an account
+func (app *KVStoreApplication) setReserved(account string, value Amount) error {
+	journalEntry(app, reservedMap, account)
+	reservedMap[account] = value
+	if err := app.onGoingBlock.Set([]byte("reserved/"+account), []byte(value.String())); err != nil {
+		return fmt.Errorf("writing reserved balance of %s: %w", account, err)
+	}
+	return nil
+}
+
+// setPending stores a pending transfer record.
+func (app *KVStoreApplication) setPending(id string, record *pendingRecord) error {
+	journalEntry(app, pendingMap, id)
+	pendingMap[id] = record
+	if err := app.onGoingBlock.Set([]byte("pending/"+id), encodePendingRecord(record)); err != nil {
+		return fmt.Errorf("writing pending transfer %s: %w", id, err)
+	}
+	return nil
+}
+
+func encodePendingRecord(record *pendingRecord) []byte {
+	value, err := json.Marshal(record)
+	if err != nil {
+		log.Panicf("Error encoding pending transfer: %v", err)
+	}
+	return value
+}
+
+func pendingEvent(eventType string, id string, record *pendingRecord, amount Amount) abcitypes.Event {
+	return abcitypes.Event{
+		Type: eventType,
+		Attributes: []abcitypes.EventAttribute{
+			{Key: "id", Value: id, Index: true},
+			{Key: "src", Value: record.Sender, Index: true},
+			{Key: "dst", Value: record.Dest, Index: true},
+			{Key: "amount", Value: amount.Format(params.Decimals), Index: true},
+		},
+	}
+}
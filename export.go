@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	cmtjson "github.com/cometbft/cometbft/libs/json"
+	cmttypes "github.com/cometbft/cometbft/types"
+)
+
+// runExport implements the export subcommand, which writes the app state of
+// a stopped node as a genesis app_state, optionally embedded in a copy of an
+// existing genesis file.
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.StringVar(&homeDir, "cmt-home", "", "Path to the CometBFT config directory (if empty, uses $HOME/.cometbft)")
+	fs.StringVar(&dbType, "db-type", "badger", "Database type: badger, pebble, or tigerbeetle")
+	fs.StringVar(&dbPath, "db-path", "", "Path to the database")
+	fs.StringVar(&tbAddresses, "tb-addresses", "3000", "TigerBeetle addresses (comma-separated)")
+	height := fs.Int64("height", 0, "Height to export (0 for the latest); only the latest height is retained")
+	genesisFile := fs.String("genesis", "", "Genesis file to embed the app_state into, with the consensus params in force, the next height and no validators (if empty, only the app_state is written)")
+	out := fs.String("out", "", "Output file (if empty, writes to stdout)")
+	fs.Parse(args)
+
+	if homeDir == "" {
+		homeDir = os.ExpandEnv("$HOME/.cometbft")
+	}
+	if dbPath == "" {
+		dbPath = filepath.Join(homeDir, dbType)
+	}
+
+	output, err := export(*height, *genesisFile)
+	if err != nil {
+		log.Fatalf("Export failed: %v", err)
+	}
+	if *out == "" {
+		fmt.Println(string(output))
+		return
+	}
+	if err := os.WriteFile(*out, output, 0o644); err != nil {
+		log.Fatalf("Writing %s: %v", *out, err)
+	}
+}
+
+func export(height int64, genesisFile string) ([]byte, error) {
+	unlock, err := lockDatabase(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("refusing to export: %w", err)
+	}
+	defer unlock()
+
+	database, err := openDatabase(dbType, dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("opening database: %w", err)
+	}
+	defer database.Close()
+
+	app, err := NewKVStoreApplication(database)
+	if err != nil {
+		return nil, err
+	}
+	if height != 0 && height != app.height {
+		return nil, fmt.Errorf("state at height %d is not retained, only the latest height %d can be exported", height, app.height)
+	}
+
+	genesis := exportGenesis(app.height)
+	appState, err := json.MarshalIndent(genesis, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if genesisFile == "" {
+		return appState, nil
+	}
+
+	genDoc, err := cmttypes.GenesisDocFromFile(genesisFile)
+	if err != nil {
+		return nil, err
+	}
+	genDoc.AppState = appState
+	genDoc.AppHash = nil
+	// The new network continues the heights of the exported state, which
+	// unbondings and message ids refer to, under the consensus params in force
+	// and the validator set of the app_state
+	genDoc.InitialHeight = app.height + 1
+	if consensusParams != nil {
+		genDoc.ConsensusParams = consensusParams
+	}
+	genDoc.Validators = nil
+	return cmtjson.MarshalIndent(genDoc, "", "  ")
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"test/apperrors"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+// feeCollectorProposer sends fees to the account of the block proposer
+const feeCollectorProposer = "proposer"
+
+// Fee pays Amount of the native asset from Payer for a transaction. It is
+// carried as a fee=payer=amount=signature segment of the transaction, or
+// fee=payer=amount=gas_limit=signature to set the gas limit, and its signature
+// covers the messages, so it can't be moved to another transaction.
+type Fee struct {
+	Payer  string `json:"payer"`
+	Amount string `json:"amount"`
+	// GasLimit is empty if the transaction doesn't set its gas limit
+	GasLimit  string `json:"gas_limit,omitempty"`
+	Signature string `json:"signature"`
+
+	msgs []Msg
+}
+
+// parseFee decodes fee=payer=amount=signature or fee=payer=amount=gas_limit=signature.
+func parseFee(parts [][]byte) *Fee {
+	switch len(parts) {
+	case 4:
+		return &Fee{
+			Payer:     string(parts[1]),
+			Amount:    string(parts[2]),
+			Signature: string(parts[3]),
+		}
+	case 5:
+		if len(parts[3]) == 0 {
+			return nil
+		}
+		return &Fee{
+			Payer:     string(parts[1]),
+			Amount:    string(parts[2]),
+			GasLimit:  string(parts[3]),
+			Signature: string(parts[4]),
+		}
+	}
+	return nil
+}
+
+func (f *Fee) Signer() string { return f.Payer }
+
+func (f *Fee) Sig() string { return f.Signature }
+
+func (f *Fee) Challenge() []byte {
+	challenge := []byte("fee")
+	challenge = append(challenge, []byte(f.Payer)...)
+	challenge = append(challenge, []byte(f.Amount)...)
+	challenge = append(challenge, []byte(f.GasLimit)...)
+	for _, msg := range f.msgs {
+		challenge = append(challenge, msg.Challenge()...)
+	}
+	return challenge
+}
+
+// minFee returns the smallest fee a transaction must pay
+func minFee() Amount {
+	if params.MinFee == nil {
+		return Amount{}
+	}
+	return *params.MinFee
+}
+
+func isValidFee(fee *Fee, ctx *txContext) error {
+	if fee == nil {
+		if !minFee().IsZero() {
+			return apperrors.ErrInsufficientFee.Wrapf("no fee, minimum is %s", minFee())
+		}
+		return nil
+	}
+	if _, ok := keyMap[fee.Payer]; !ok {
+		return apperrors.ErrUnknownAccount.Wrapf("%q", fee.Payer)
+	}
+	amount, err := ParseAmount(fee.Amount, params.Decimals)
+	if err != nil {
+		return apperrors.ErrInvalidAmount.Wrapf("%q: %v", fee.Amount, err)
+	}
+	if amount.Cmp(minFee()) < 0 {
+		return apperrors.ErrInsufficientFee.Wrapf("%s, minimum is %s", amount, minFee())
+	}
+	if err := ctx.debit(nativeDenom(), fee.Payer, amount); err != nil {
+		return err
+	}
+	return verifySignature(fee, ctx)
+}
+
+// feeRecipient returns the account credited with the fees of a block, or an
+// empty string if they are burned
+func feeRecipient(proposer []byte) string {
+	collector := params.FeeCollector
+	if collector == feeCollectorProposer {
+		collector = params.ValidatorAccounts[strings.ToUpper(hex.EncodeToString(proposer))]
+	}
+	if _, ok := keyMap[collector]; !ok {
+		return ""
+	}
+	return collector
+}
+
+// chargeFee moves a transaction's fee from its payer to recipient, or burns it
+// if there is no recipient
+func (app *KVStoreApplication) chargeFee(fee *Fee, recipient string) (abcitypes.Event, error) {
+	denom := nativeDenom()
+	amount, err := parseAmount(fee.Amount, params.Decimals)
+	if err != nil {
+		return abcitypes.Event{}, err
+	}
+
+	if err := app.debit(denom, fee.Payer, amount); err != nil {
+		return abcitypes.Event{}, err
+	}
+	if recipient != "" {
+		err = app.credit(denom, recipient, amount)
+	} else {
+		err = app.burn(denom, amount)
+	}
+	if err != nil {
+		return abcitypes.Event{}, err
+	}
+
+	return abcitypes.Event{
+		Type: "fee",
+		Attributes: []abcitypes.EventAttribute{
+			{Key: "payer", Value: fee.Payer, Index: true},
+			{Key: "amount", Value: fee.Amount, Index: true},
+			{Key: "recipient", Value: recipient, Index: true},
+		},
+	}, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"strconv"
+
+	"test/apperrors"
+)
+
+// Gas costs. A transaction pays a base cost and a cost per byte and per
+// message up front, then gas for the signatures it verifies and for the state
+// it reads and writes while it runs.
+const (
+	gasPerTx        = 1000
+	gasPerTxByte    = 10
+	gasPerMsg       = 500
+	gasPerSignature = 1000
+	gasPerRead      = 100
+	gasPerWrite     = 200
+)
+
+// GasMeter counts the gas consumed by a transaction against its limit. A nil
+// meter counts nothing, for the state changes made outside of transactions.
+type GasMeter struct {
+	limit uint64
+	used  uint64
+}
+
+func NewGasMeter(limit uint64) *GasMeter {
+	return &GasMeter{limit: limit}
+}
+
+// Consume adds amount to the gas used, failing once the limit is exceeded
+func (g *GasMeter) Consume(amount uint64) error {
+	if g == nil {
+		return nil
+	}
+	used, carry := bits.Add64(g.used, amount, 0)
+	if carry != 0 {
+		used = math.MaxUint64
+	}
+	g.used = used
+	return g.Err()
+}
+
+// Err returns ErrOutOfGas once more gas than the limit has been consumed
+func (g *GasMeter) Err() error {
+	if g == nil || g.used <= g.limit {
+		return nil
+	}
+	return apperrors.ErrOutOfGas.Wrapf("limit is %d", g.limit)
+}
+
+func (g *GasMeter) Limit() uint64 { return g.limit }
+
+// Used returns the gas consumed, at most the limit
+func (g *GasMeter) Used() uint64 { return min(g.used, g.limit) }
+
+// intrinsicGas returns the gas a transaction of size bytes consumes before it
+// is checked against the state
+func intrinsicGas(transaction *Transaction, size int) uint64 {
+	gas := uint64(gasPerTx) + uint64(size)*gasPerTxByte
+	return gas + uint64(len(transaction.Msgs))*gasPerMsg
+}
+
+// txGasMeter returns a meter with the gas limit of a transaction: the limit
+// set in its fee, or else the max_tx_gas param, lowered to gasLeft unless it
+// is negative
+func txGasMeter(transaction *Transaction, gasLeft int64) (*GasMeter, error) {
+	limit := params.MaxTxGas
+	if limit == 0 {
+		limit = math.MaxUint64
+	}
+	if transaction.Fee != nil && transaction.Fee.GasLimit != "" {
+		gasLimit, err := strconv.ParseUint(transaction.Fee.GasLimit, 10, 64)
+		if err != nil || gasLimit == 0 {
+			return nil, apperrors.ErrInvalidGasLimit.Wrapf("%q", transaction.Fee.GasLimit)
+		}
+		if gasLimit > limit {
+			return nil, apperrors.ErrInvalidGasLimit.Wrapf("%d is above max_tx_gas %d", gasLimit, limit)
+		}
+		limit = gasLimit
+	}
+	if gasLeft >= 0 {
+		limit = min(limit, uint64(gasLeft))
+	}
+	return NewGasMeter(limit), nil
+}
+
+// gasWanted returns the gas a transaction asks for: its limit if set, or else
+// the gas it consumes
+func gasWanted(transaction *Transaction, meter *GasMeter) uint64 {
+	if (transaction.Fee != nil && transaction.Fee.GasLimit != "") || params.MaxTxGas > 0 {
+		return meter.Limit()
+	}
+	return meter.Used()
+}
+
+// txGasWanted returns the gas a transaction asks for without checking it
+// against the state, its intrinsic gas if it has no limit, and false if it
+// can't be parsed or is over its gas limit
+func txGasWanted(tx []byte) (int64, bool) {
+	var transaction Transaction
+	if err := transaction.FromBytes(tx); err != nil {
+		return 0, false
+	}
+	meter, err := txGasMeter(&transaction, -1)
+	if err != nil || meter.Consume(intrinsicGas(&transaction, len(tx))) != nil {
+		return 0, false
+	}
+	return gasToInt64(gasWanted(&transaction, meter)), true
+}
+
+// gasToInt64 converts gas for ABCI responses, which use signed integers
+func gasToInt64(gas uint64) int64 {
+	if gas > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(gas)
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+
+	cmttypes "github.com/cometbft/cometbft/types"
+)
+
+// GenesisAccount is an account in the app_state of a genesis file
+type GenesisAccount struct {
+	Id     string `json:"id"`
+	PubKey string `json:"pub_key"`
+	// Balance is in the native asset, Balances in the other assets by denom
+	Balance  string            `json:"balance"`
+	Balances map[string]string `json:"balances,omitempty"`
+	Nonce    string            `json:"nonce,omitempty"`
+}
+
+// GenesisAsset is a non-native asset in the app_state of a genesis file
+type GenesisAsset struct {
+	Denom string `json:"denom"`
+	Asset
+}
+
+// GenesisPendingTransfer is a pending transfer in the app_state of a genesis
+// file. Settled transfers are included so that their ids are never reused.
+type GenesisPendingTransfer struct {
+	Id string `json:"id"`
+	pendingRecord
+}
+
+// GenesisValidator is a member of the validator set in the app_state of a
+// genesis file, by upper case hex address
+type GenesisValidator struct {
+	Address string `json:"address"`
+	Validator
+}
+
+// GenesisDelegation is the stake of an account in a validator in the
+// app_state of a genesis file
+type GenesisDelegation struct {
+	Validator string `json:"validator"`
+	Account   string `json:"account"`
+	Amount    Amount `json:"amount"`
+}
+
+// GenesisState is the app_state of a genesis file
+type GenesisState struct {
+	// Height the state was exported at, informational only
+	Height           int64                    `json:"height,omitempty"`
+	Params           Params                   `json:"params"`
+	Assets           []GenesisAsset           `json:"assets,omitempty"`
+	Accounts         []GenesisAccount         `json:"accounts"`
+	PendingTransfers []GenesisPendingTransfer `json:"pending_transfers,omitempty"`
+	// MsgIds holds the height at which each message id was used, by
+	// kind/signer/id, so that the messages can't be replayed
+	MsgIds map[string]int64 `json:"msg_ids,omitempty"`
+	// Validators replace the validators of the genesis file, which must be
+	// empty or hold the same voting powers
+	Validators  []GenesisValidator     `json:"validators,omitempty"`
+	Delegations []GenesisDelegation    `json:"delegations,omitempty"`
+	Unbondings  []Unbonding            `json:"unbondings,omitempty"`
+	Prices      map[string]PriceRecord `json:"prices,omitempty"`
+}
+
+// defaultGenesisState returns the built-in accounts used when the genesis file
+// has no app_state
+func defaultGenesisState() GenesisState {
+	genesis := GenesisState{Params: params}
+	for _, account := range sortedKeys(keyMap) {
+		genesis.Accounts = append(genesis.Accounts, GenesisAccount{
+			Id:      account,
+			PubKey:  keyMap[account],
+			Balance: balanceOf(nativeDenom(), account).String(),
+		})
+	}
+	return genesis
+}
+
+// exportGenesis returns the current state as a genesis app_state. The
+// consensus params are not part of it, export puts them in the genesis file.
+func exportGenesis(height int64) GenesisState {
+	genesis := GenesisState{Height: height, Params: params}
+	for _, denom := range sortedKeys(assetMap) {
+		genesis.Assets = append(genesis.Assets, GenesisAsset{Denom: denom, Asset: *assetMap[denom]})
+	}
+	for _, account := range sortedKeys(keyMap) {
+		genesisAccount := GenesisAccount{
+			Id:      account,
+			PubKey:  keyMap[account],
+			Balance: balanceOf(nativeDenom(), account).String(),
+			Nonce:   strconv.FormatUint(nonceMap[account], 10),
+		}
+		for _, denom := range sortedKeys(assetMap) {
+			if balance, ok := balanceMap[denom][account]; ok {
+				if genesisAccount.Balances == nil {
+					genesisAccount.Balances = map[string]string{}
+				}
+				genesisAccount.Balances[denom] = balance.String()
+			}
+		}
+		genesis.Accounts = append(genesis.Accounts, genesisAccount)
+	}
+	for _, id := range sortedKeys(pendingMap) {
+		genesis.PendingTransfers = append(genesis.PendingTransfers, GenesisPendingTransfer{
+			Id:            id,
+			pendingRecord: *pendingMap[id],
+		})
+	}
+	if len(msgIdMap) > 0 {
+		genesis.MsgIds = maps.Clone(msgIdMap)
+	}
+	for _, address := range sortedKeys(validatorMap) {
+		genesis.Validators = append(genesis.Validators, GenesisValidator{Address: address, Validator: *validatorMap[address]})
+	}
+	for _, address := range sortedKeys(delegationMap) {
+		for _, account := range sortedKeys(delegationMap[address]) {
+			genesis.Delegations = append(genesis.Delegations, GenesisDelegation{
+				Validator: address,
+				Account:   account,
+				Amount:    delegationMap[address][account],
+			})
+		}
+	}
+	for _, height := range sortedKeys(unbondingMap) {
+		for _, key := range sortedKeys(unbondingMap[height]) {
+			genesis.Unbondings = append(genesis.Unbondings, unbondingMap[height][key])
+		}
+	}
+	if len(priceMap) > 0 {
+		genesis.Prices = maps.Clone(priceMap)
+	}
+	return genesis
+}
+
+// validAccountID checks that id is a positive integer without leading zeros,
+// the account ids TigerBeetle supports. Native balances are stored under the
+// bare id, which can't collide with the other keys of the state.
+func validAccountID(id string) error {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil || n == 0 || strconv.FormatUint(n, 10) != id {
+		return fmt.Errorf("invalid account id %q, expected a positive integer", id)
+	}
+	return nil
+}
+
+// importGenesis replaces the state with a genesis app_state and writes it to
+// the ongoing block
+func (app *KVStoreApplication) importGenesis(genesis GenesisState) error {
+	resetState()
+
+	if genesis.Params.Denom != "" && !denomPattern.MatchString(genesis.Params.Denom) {
+		return fmt.Errorf("invalid native denom %q", genesis.Params.Denom)
+	}
+	if genesis.Params.Decimals > maxAmountDecimals {
+		return fmt.Errorf("decimals %d exceeds the maximum of %d", genesis.Params.Decimals, maxAmountDecimals)
+	}
+	if err := app.setParams(genesis.Params); err != nil {
+		return err
+	}
+
+	for _, asset := range genesis.Assets {
+		if !denomPattern.MatchString(asset.Denom) {
+			return fmt.Errorf("invalid denom %q", asset.Denom)
+		}
+		if _, ok := denomDecimals(asset.Denom); ok {
+			return fmt.Errorf("duplicate asset %s", asset.Denom)
+		}
+		if asset.Decimals > maxAmountDecimals {
+			return fmt.Errorf("asset %s: decimals %d exceeds the maximum of %d", asset.Denom, asset.Decimals, maxAmountDecimals)
+		}
+		if err := app.setAsset(asset.Denom, &Asset{Decimals: asset.Decimals, Issuer: asset.Issuer}); err != nil {
+			return err
+		}
+	}
+
+	for _, account := range genesis.Accounts {
+		if err := validAccountID(account.Id); err != nil {
+			return err
+		}
+		if _, ok := keyMap[account.Id]; ok {
+			return fmt.Errorf("duplicate account %s", account.Id)
+		}
+		if _, err := parseKeySet(account.PubKey); err != nil {
+			return fmt.Errorf("account %s: %w", account.Id, err)
+		}
+		balance, err := ParseAmount(account.Balance, 0)
+		if err != nil {
+			return fmt.Errorf("account %s: invalid balance %q", account.Id, account.Balance)
+		}
+		var nonce uint64
+		if account.Nonce != "" {
+			if nonce, err = strconv.ParseUint(account.Nonce, 10, 64); err != nil {
+				return fmt.Errorf("account %s: invalid nonce %q", account.Id, account.Nonce)
+			}
+		}
+
+		if err := app.setPubKey(account.Id, account.PubKey); err != nil {
+			return err
+		}
+		if err := app.setBalance(nativeDenom(), account.Id, balance); err != nil {
+			return err
+		}
+		for _, denom := range sortedKeys(account.Balances) {
+			if _, ok := assetMap[denom]; !ok {
+				return fmt.Errorf("account %s: unknown asset %q", account.Id, denom)
+			}
+			balance, err := ParseAmount(account.Balances[denom], 0)
+			if err != nil {
+				return fmt.Errorf("account %s: invalid %s balance %q", account.Id, denom, account.Balances[denom])
+			}
+			if err := app.setBalance(denom, account.Id, balance); err != nil {
+				return err
+			}
+		}
+		if nonce > 0 {
+			if err := app.setNonce(account.Id, nonce); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, denom := range sortedKeys(assetMap) {
+		if issuer := assetMap[denom].Issuer; issuer != "" {
+			if _, ok := keyMap[issuer]; !ok {
+				return fmt.Errorf("asset %s: unknown issuer %s", denom, issuer)
+			}
+		}
+	}
+
+	if collector := params.FeeCollector; collector != "" && collector != feeCollectorProposer {
+		if _, ok := keyMap[collector]; !ok {
+			return fmt.Errorf("unknown fee collector %s", collector)
+		}
+	}
+	if fraction := params.SlashFraction; fraction != "" {
+		if _, err := parseFraction(fraction); err != nil {
+			return fmt.Errorf("invalid slash fraction %q: %w", fraction, err)
+		}
+	}
+	switch params.RewardRecipients {
+	case "", rewardProposer, rewardSigners:
+	default:
+		return fmt.Errorf("invalid reward recipients %q", params.RewardRecipients)
+	}
+	if params.UnbondingBlocks < 0 {
+		return fmt.Errorf("negative unbonding period %d", params.UnbondingBlocks)
+	}
+	if params.InvariantInterval < 0 {
+		return fmt.Errorf("negative invariant interval %d", params.InvariantInterval)
+	}
+	if admin := params.Admin; admin != "" {
+		if _, ok := keyMap[admin]; !ok {
+			return fmt.Errorf("unknown admin %s", admin)
+		}
+	}
+	for _, address := range sortedKeys(params.ValidatorAccounts) {
+		if address != strings.ToUpper(address) {
+			return fmt.Errorf("validator address %s must be upper case hex", address)
+		}
+		if _, ok := keyMap[params.ValidatorAccounts[address]]; !ok {
+			return fmt.Errorf("validator %s: unknown account %s", address, params.ValidatorAccounts[address])
+		}
+	}
+
+	for _, p := range genesis.PendingTransfers {
+		record := p.pendingRecord
+		if id, err := strconv.ParseUint(p.Id, 10, 64); err != nil || strconv.FormatUint(id, 10) != p.Id {
+			return fmt.Errorf("pending transfer %q: id must be a number without leading zeros", p.Id)
+		}
+		if _, ok := pendingMap[p.Id]; ok {
+			return fmt.Errorf("duplicate pending transfer %s", p.Id)
+		}
+		if _, ok := keyMap[record.Sender]; !ok {
+			return fmt.Errorf("pending transfer %s: unknown sender %s", p.Id, record.Sender)
+		}
+		if _, ok := keyMap[record.Dest]; !ok {
+			return fmt.Errorf("pending transfer %s: unknown dest %s", p.Id, record.Dest)
+		}
+		if record.Amount.IsZero() {
+			return fmt.Errorf("pending transfer %s: amount must be positive", p.Id)
+		}
+		switch record.Status {
+		case pendingStatusPending:
+			reserved, err := reservedMap[record.Sender].Add(record.Amount)
+			if err != nil {
+				return fmt.Errorf("pending transfer %s: %w", p.Id, err)
+			}
+			if err := app.setReserved(record.Sender, reserved); err != nil {
+				return err
+			}
+			if ledger, ok := app.nativeLedger(); ok {
+				if err := createNativePending(ledger, p.Id, &record); err != nil {
+					return err
+				}
+			}
+		case pendingStatusPosted, pendingStatusVoided, pendingStatusExpired:
+		default:
+			return fmt.Errorf("pending transfer %s: invalid status %q", p.Id, record.Status)
+		}
+		if err := app.setPending(p.Id, &record); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range sortedKeys(genesis.MsgIds) {
+		_, signer, ok := strings.Cut(key, "/")
+		if signer, _, ok = strings.Cut(signer, "/"); !ok {
+			return fmt.Errorf("invalid message id %q, expected kind/signer/id", key)
+		}
+		if _, known := keyMap[signer]; !known {
+			return fmt.Errorf("message id %s: unknown signer %s", key, signer)
+		}
+		if err := app.setMsgId(key, genesis.MsgIds[key]); err != nil {
+			return err
+		}
+	}
+
+	if err := app.importStaking(genesis); err != nil {
+		return err
+	}
+
+	for _, pair := range sortedKeys(genesis.Prices) {
+		if !pairPattern.MatchString(pair) {
+			return fmt.Errorf("invalid price pair %q", pair)
+		}
+		if err := app.setPrice(pair, genesis.Prices[pair]); err != nil {
+			return err
+		}
+	}
+
+	for _, denom := range append([]string{nativeDenom()}, sortedKeys(assetMap)...) {
+		total, err := totalSupply(denom)
+		if err != nil {
+			return err
+		}
+		if err := app.setSupply(denom, Supply{Genesis: total}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importStaking imports the validators, delegations and unbondings of a
+// genesis app_state, checking that the stake of each validator is the sum of
+// its delegations
+func (app *KVStoreApplication) importStaking(genesis GenesisState) error {
+	for _, v := range genesis.Validators {
+		pubKey, err := parseValidatorPubKey(v.PubKey)
+		if err != nil {
+			return fmt.Errorf("validator %s: %w", v.Address, err)
+		}
+		if address := validatorAddress(pubKey); address != v.Address {
+			return fmt.Errorf("validator %s: the address of its public key is %s", v.Address, address)
+		}
+		if _, ok := validatorMap[v.Address]; ok {
+			return fmt.Errorf("duplicate validator %s", v.Address)
+		}
+		if v.Power < 0 || v.Power > cmttypes.MaxTotalVotingPower || v.BasePower < 0 || v.BasePower > cmttypes.MaxTotalVotingPower {
+			return fmt.Errorf("validator %s: invalid power %d or base power %d", v.Address, v.Power, v.BasePower)
+		}
+		validator := v.Validator
+		if err := app.setValidator(v.Address, &validator); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range genesis.Delegations {
+		if _, ok := validatorMap[d.Validator]; !ok {
+			return fmt.Errorf("delegation of %s: unknown validator %s", d.Account, d.Validator)
+		}
+		if _, ok := keyMap[d.Account]; !ok {
+			return fmt.Errorf("delegation to %s: unknown account %s", d.Validator, d.Account)
+		}
+		if _, ok := delegationMap[d.Validator][d.Account]; ok {
+			return fmt.Errorf("duplicate delegation of %s to %s", d.Account, d.Validator)
+		}
+		if d.Amount.IsZero() {
+			return fmt.Errorf("delegation of %s to %s: amount must be positive", d.Account, d.Validator)
+		}
+		if err := app.setDelegation(d.Validator, d.Account, d.Amount); err != nil {
+			return err
+		}
+	}
+	if err := checkStake(); err != nil {
+		return err
+	}
+
+	for _, u := range genesis.Unbondings {
+		key := unbondingKey(u.CompletesAt, u.Validator, u.Account)
+		if _, ok := validatorMap[u.Validator]; !ok {
+			return fmt.Errorf("unbonding %s: unknown validator %s", key, u.Validator)
+		}
+		if _, ok := keyMap[u.Account]; !ok {
+			return fmt.Errorf("unbonding %s: unknown account %s", key, u.Account)
+		}
+		if _, ok := unbondingMap[u.CompletesAt][delegationKey(u.Validator, u.Account)]; ok {
+			return fmt.Errorf("duplicate unbonding %s", key)
+		}
+		if u.Amount.IsZero() || u.CompletesAt <= 0 {
+			return fmt.Errorf("unbonding %s: amount and completion height must be positive", key)
+		}
+		if err := app.setUnbonding(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
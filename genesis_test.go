@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"test/db"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	cmted25519 "github.com/cometbft/cometbft/crypto/ed25519"
+)
+
+// stakingGenesis returns testGenesis with a validator holding the stake of
+// account 1, an unbonding of account 2 and an oracle price
+func stakingGenesis(t *testing.T) (*abcitypes.InitChainRequest, GenesisState) {
+	t.Helper()
+	req := testGenesis(t)
+	var genesis GenesisState
+	if err := json.Unmarshal(req.AppStateBytes, &genesis); err != nil {
+		t.Fatal(err)
+	}
+	pubKey := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)).Public().(ed25519.PublicKey)
+	address := validatorAddress(pubKey)
+	for i := range genesis.Accounts {
+		genesis.Accounts[i].Nonce = "0"
+	}
+	genesis.Height = 10
+	genesis.Validators = []GenesisValidator{{
+		Address:   address,
+		Validator: Validator{PubKey: hex.EncodeToString(pubKey), Power: 15, BasePower: 10, Stake: NewAmount(5_000_000)},
+	}}
+	genesis.Delegations = []GenesisDelegation{{Validator: address, Account: "1", Amount: NewAmount(5_000_000)}}
+	genesis.Unbondings = []Unbonding{{Account: "2", Validator: address, Amount: NewAmount(300), CompletesAt: 20}}
+	genesis.Prices = map[string]PriceRecord{"ATOM/USD": {Price: "9.5", Height: 9, Votes: 1}}
+	req.AppStateBytes, _ = json.Marshal(genesis)
+	req.InitialHeight = 11
+	return req, genesis
+}
+
+func newGenesisApp(t *testing.T) *KVStoreApplication {
+	t.Helper()
+	database, err := db.NewPebbleDB(t.TempDir(), db.PebbleOptions{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	app, err := NewKVStoreApplication(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return app
+}
+
+func TestGenesisStakingRoundTrip(t *testing.T) {
+	req, genesis := stakingGenesis(t)
+	app := newGenesisApp(t)
+	res, err := app.InitChain(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without validators in the genesis file, those of the app_state are used
+	pubKey, _ := hex.DecodeString(genesis.Validators[0].PubKey)
+	want := []abcitypes.ValidatorUpdate{abcitypes.NewValidatorUpdate(cmted25519.PubKey(pubKey), 15)}
+	if !reflect.DeepEqual(res.Validators, want) {
+		t.Fatalf("validators %v, want %v", res.Validators, want)
+	}
+
+	exported := exportGenesis(app.height)
+	for _, field := range []struct {
+		name      string
+		got, want any
+	}{
+		{"validators", exported.Validators, genesis.Validators},
+		{"delegations", exported.Delegations, genesis.Delegations},
+		{"unbondings", exported.Unbondings, genesis.Unbondings},
+		{"prices", exported.Prices, genesis.Prices},
+		{"accounts", exported.Accounts, genesis.Accounts},
+	} {
+		if !reflect.DeepEqual(field.got, field.want) {
+			t.Errorf("exported %s %v, want %v", field.name, field.got, field.want)
+		}
+	}
+}
+
+func TestGenesisValidatorsMismatch(t *testing.T) {
+	req, genesis := stakingGenesis(t)
+	pubKey, _ := hex.DecodeString(genesis.Validators[0].PubKey)
+
+	// A genesis file with the same voting powers is accepted
+	req.Validators = []abcitypes.ValidatorUpdate{abcitypes.NewValidatorUpdate(cmted25519.PubKey(pubKey), 15)}
+	res, err := newGenesisApp(t).InitChain(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Validators) != 0 {
+		t.Fatalf("validators %v, want those of the genesis file", res.Validators)
+	}
+
+	req.Validators = []abcitypes.ValidatorUpdate{abcitypes.NewValidatorUpdate(cmted25519.PubKey(pubKey), 10)}
+	if _, err := newGenesisApp(t).InitChain(context.Background(), req); err == nil {
+		t.Fatal("a genesis file with another voting power is accepted")
+	}
+}
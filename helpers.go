@@ -2,50 +2,145 @@ package main
 
 import (
 	"bytes"
-	"crypto/ed25519"
-	"encoding/hex"
 	"errors"
-	"strconv"
+	"fmt"
+
+	"test/apperrors"
 )
 
+// Msg is a single signed operation carried by a transaction.
+type Msg interface {
+	// Signer returns the account whose key must have signed the message.
+	Signer() string
+	// Challenge returns the bytes covered by the signature.
+	Challenge() []byte
+	// Sig returns the hex encoded signature.
+	Sig() string
+}
+
 type Transfer struct {
-	Id 	  string `json:"id"`
-	Sender    string `json:"sender"`
-	Dest      string `json:"dest"`
-	Amount    string `json:"amount"`
+	Id     string `json:"id"`
+	Sender string `json:"sender"`
+	Dest   string `json:"dest"`
+	Amount string `json:"amount"`
+	// Denom is empty for transfers of the native asset
+	Denom     string `json:"denom,omitempty"`
 	Signature string `json:"signature"`
 }
 
 type Transaction struct {
-	Transfers []Transfer `json:"transfers"`
+	Msgs []Msg `json:"msgs"`
+	// Fee is nil if the transaction pays no fee
+	Fee *Fee `json:"fee,omitempty"`
 }
 
+func (t *Transfer) Signer() string { return t.Sender }
+
+func (t *Transfer) Sig() string { return t.Signature }
+
 func (t *Transfer) Challenge() []byte {
 	challenge := []byte{}
 	challenge = append(challenge, []byte(t.Id)...)
 	challenge = append(challenge, []byte(t.Sender)...)
 	challenge = append(challenge, []byte(t.Dest)...)
 	challenge = append(challenge, []byte(t.Amount)...)
+	challenge = append(challenge, []byte(t.Denom)...)
 	return challenge
 }
 
+// denom returns the denomination the transfer moves
+func (t *Transfer) denom() string {
+	if t.Denom == "" {
+		return nativeDenom()
+	}
+	return t.Denom
+}
+
 func (t *Transaction) FromBytes(data []byte) error {
-	transfersData := bytes.Split(data, []byte(":"))
-	for _, transferData := range transfersData {
-		parts := bytes.Split(transferData, []byte("="))
-		if len(parts) != 5 {
+	// Only proposers put the vote extensions in a block
+	if isOracleTx(data) {
+		return errors.New("invalid transaction data: reserved oracle prefix")
+	}
+	msgsData := bytes.Split(data, []byte(":"))
+	for _, msgData := range msgsData {
+		parts := bytes.Split(msgData, []byte("="))
+
+		if string(parts[0]) == "fee" {
+			if t.Fee != nil {
+				return errors.New("invalid transaction data: more than one fee")
+			}
+			if t.Fee = parseFee(parts); t.Fee == nil {
+				return errors.New("invalid transaction data")
+			}
+			continue
+		}
+
+		var msg Msg
+		switch string(parts[0]) {
+		case "pending":
+			msg = parsePendingTransfer(parts)
+		case "post":
+			msg = parsePostPendingTransfer(parts)
+		case "void":
+			msg = parseVoidPendingTransfer(parts)
+		case "asset":
+			msg = parseCreateAsset(parts)
+		case "mint":
+			msg = parseMint(parts)
+		case "burn":
+			msg = parseBurn(parts)
+		case "validator":
+			msg = parseUpdateValidator(parts)
+		case "bond":
+			msg = parseBond(parts)
+		case "unbond":
+			msg = parseUnbond(parts)
+		case "consensus":
+			msg = parseUpdateConsensusParams(parts)
+		case "rotate":
+			msg = parseRotateKey(parts)
+		default:
+			msg = parseTransfer(parts)
+		}
+		if msg == nil {
 			return errors.New("invalid transaction data")
 		}
 
-		transfer := Transfer{
+		t.Msgs = append(t.Msgs, msg)
+	}
+	if len(t.Msgs) == 0 {
+		return errors.New("invalid transaction data: no messages")
+	}
+	if t.Fee != nil {
+		t.Fee.msgs = t.Msgs
+	}
+	return nil
+}
+
+// parseTransfer decodes id=sender=dest=amount=signature for the native asset,
+// or id=sender=dest=amount=denom=signature.
+func parseTransfer(parts [][]byte) Msg {
+	switch len(parts) {
+	case 5:
+		return &Transfer{
 			Id:        string(parts[0]),
 			Sender:    string(parts[1]),
 			Dest:      string(parts[2]),
 			Amount:    string(parts[3]),
 			Signature: string(parts[4]),
 		}
-
-		t.Transfers = append(t.Transfers, transfer)
+	case 6:
+		if len(parts[4]) == 0 {
+			return nil
+		}
+		return &Transfer{
+			Id:        string(parts[0]),
+			Sender:    string(parts[1]),
+			Dest:      string(parts[2]),
+			Amount:    string(parts[3]),
+			Denom:     string(parts[4]),
+			Signature: string(parts[5]),
+		}
 	}
 	return nil
 }
@@ -57,47 +152,232 @@ var keyMap = map[string]string{
 	"4": "d06a22ce4b7a59ceac3a898504901f41e27491ed3cc90e8ee46ac43e9305d61a",
 }
 
-var balanceMap = map[string]uint64{
-	"1": 1000000000,
-	"2": 1000000000,
-	"3": 1000000000,
-	"4": 1000000000,
+// balanceMap holds the balances of each denomination by account
+var balanceMap = map[string]map[string]Amount{
+	defaultDenom: {
+		"1": NewAmount(1000000000),
+		"2": NewAmount(1000000000),
+		"3": NewAmount(1000000000),
+		"4": NewAmount(1000000000),
+	},
+}
+
+// nonceMap counts the messages executed for each signer
+var nonceMap = map[string]uint64{}
+
+// uniqueMsg is a message that would have the same effect every time it runs,
+// so each of its ids can only be used once by a signer
+type uniqueMsg interface {
+	Msg
+	// msgId returns the kind of the message and its id
+	msgId() (kind, id string)
+}
+
+// msgIdMap holds the height at which each id of a uniqueMsg was used, by
+// msgIdKey
+var msgIdMap = map[string]int64{}
+
+// msgIdKey returns the key of the id of a uniqueMsg
+func msgIdKey(msg uniqueMsg) string {
+	kind, id := msg.msgId()
+	return kind + "/" + msg.Signer() + "/" + id
+}
+
+// txCheck is the outcome of validating a transaction
+type txCheck struct {
+	// err is nil if the transaction is valid
+	err error
+	tx  *Transaction
+	// gas meters the transaction, nil if it can't be decoded
+	gas *GasMeter
+}
+
+// gasInfo returns the gas wanted and used by the transaction so far
+func (c txCheck) gasInfo() (wanted, used int64) {
+	if c.gas == nil {
+		return 0, 0
+	}
+	return gasToInt64(gasWanted(c.tx, c.gas)), gasToInt64(c.gas.Used())
+}
+
+// executingHeight returns the height of the block being executed
+func (app *KVStoreApplication) executingHeight() int64 {
+	return app.height + 1
 }
 
-func (app *KVStoreApplication) isValid(tx []byte) uint32 {
+// isValid validates a transaction, metering the gas it consumes within the
+// gas left in the block, none if gasLeft is negative
+func (app *KVStoreApplication) isValid(tx []byte, gasLeft int64) txCheck {
 	var transaction Transaction
 	if err := transaction.FromBytes(tx); err != nil {
-		return 2
+		return txCheck{err: apperrors.ErrTxDecode.Wrapf("%v", err)}
 	}
 
-	for _, transfer := range transaction.Transfers {
-		if _, ok := keyMap[transfer.Sender]; !ok {
-			return 3
-		}
+	meter, err := txGasMeter(&transaction, gasLeft)
+	if err != nil {
+		return txCheck{err: err}
+	}
+	check := txCheck{tx: &transaction, gas: meter}
+	if check.err = meter.Consume(intrinsicGas(&transaction, len(tx))); check.err != nil {
+		return check
+	}
+	check.err = app.isValidTransaction(&transaction, meter)
+	return check
+}
 
-		if _, ok := keyMap[transfer.Dest]; !ok {
-			return 4
-		}
-		amount, err := strconv.ParseUint(transfer.Amount, 10, 64)
-		if err != nil {
-			return 8
-		}
-		if balanceMap[transfer.Sender] < amount {
-			return 5
+// isValidTransaction validates the fee and messages of a transaction against
+// the state, consuming gas for the signatures it verifies
+func (app *KVStoreApplication) isValidTransaction(transaction *Transaction, gas *GasMeter) error {
+	ctx := newTxContext(gas)
+	ctx.height = app.executingHeight()
+	// The fee is charged before the messages run
+	if err := isValidFee(transaction.Fee, ctx); err != nil {
+		return fmt.Errorf("fee: %w", err)
+	}
+	for i, msg := range transaction.Msgs {
+		if err := isValidMsg(msg, ctx); err != nil {
+			return fmt.Errorf("message %d: %w", i, err)
 		}
+	}
+	return nil
+}
 
-		pubBytes, err := hex.DecodeString(keyMap[transfer.Sender])
-		if err != nil {
-			return 6
-		}
-		pubKey := ed25519.PublicKey(pubBytes)
-		signatureBytes, err := hex.DecodeString(transfer.Signature)
-		if err != nil {
-			return 9
-		}
-		if !ed25519.Verify(pubKey, transfer.Challenge(), signatureBytes) {
-			return 7
+// isValidMsg validates a message on top of the earlier messages of its
+// transaction
+func isValidMsg(msg Msg, ctx *txContext) error {
+	if _, ok := keyMap[msg.Signer()]; !ok {
+		return apperrors.ErrUnknownAccount.Wrapf("%q", msg.Signer())
+	}
+
+	var err error
+	switch msg := msg.(type) {
+	case *Transfer:
+		err = isValidTransfer(msg, ctx)
+	case *PendingTransfer:
+		err = isValidPendingTransfer(msg, ctx)
+	case *PostPendingTransfer:
+		err = isValidPostPendingTransfer(msg, ctx)
+	case *VoidPendingTransfer:
+		err = isValidVoidPendingTransfer(msg, ctx)
+	case *CreateAsset:
+		err = isValidCreateAsset(msg, ctx)
+	case *Mint:
+		err = isValidMint(msg, ctx)
+	case *Burn:
+		err = isValidBurn(msg, ctx)
+	case *UpdateValidator:
+		err = isValidUpdateValidator(msg, ctx)
+	case *Bond:
+		err = isValidBond(msg, ctx)
+	case *Unbond:
+		err = isValidUnbond(msg, ctx)
+	case *UpdateConsensusParams:
+		err = isValidUpdateConsensusParams(msg, ctx)
+	case *RotateKey:
+		err = isValidRotateKey(msg, ctx)
+	}
+	if err != nil {
+		return err
+	}
+	if msg, ok := msg.(uniqueMsg); ok {
+		if err := ctx.useMsgId(msg); err != nil {
+			return err
 		}
 	}
-	return 0
+	return verifySignature(msg, ctx)
+}
+
+// txContext tracks what the earlier messages of a transaction consume, since
+// every message is validated against the state before the transaction runs
+type txContext struct {
+	// height is the height of the block the transaction runs in
+	height int64
+	// debits is the amount already taken from each balance, by balance key
+	debits map[string]Amount
+	// pendingIds are the pending transfers already created or settled
+	pendingIds map[string]bool
+	// denoms are the assets already created
+	denoms map[string]bool
+	// mints is the amount of each asset already minted
+	mints map[string]Amount
+	// powers are the validator powers already updated, by address
+	powers map[string]int64
+	// stakes are the validator stakes already changed, by address
+	stakes map[string]Amount
+	// delegations are the delegations already changed, by delegationKey
+	delegations map[string]Amount
+	// consensusUpdated is set once the consensus params are updated
+	consensusUpdated bool
+	// rotations are the accounts whose key is already rotated
+	rotations map[string]bool
+	// msgIds are the ids of uniqueMsg already used, by msgIdKey
+	msgIds map[string]bool
+	// gas meters the signatures verified
+	gas *GasMeter
+}
+
+func newTxContext(gas *GasMeter) *txContext {
+	return &txContext{
+		gas:         gas,
+		debits:      map[string]Amount{},
+		pendingIds:  map[string]bool{},
+		denoms:      map[string]bool{},
+		mints:       map[string]Amount{},
+		powers:      map[string]int64{},
+		stakes:      map[string]Amount{},
+		delegations: map[string]Amount{},
+		rotations:   map[string]bool{},
+		msgIds:      map[string]bool{},
+	}
+}
+
+// useMsgId checks that the id of msg hasn't been used by its signer and
+// records it
+func (ctx *txContext) useMsgId(msg uniqueMsg) error {
+	key := msgIdKey(msg)
+	if _, ok := msgIdMap[key]; ok || ctx.msgIds[key] {
+		kind, id := msg.msgId()
+		return apperrors.ErrMsgIdUsed.Wrapf("%s %s of %s", kind, id, msg.Signer())
+	}
+	ctx.msgIds[key] = true
+	return nil
+}
+
+// debit checks that account can spend amount of denom on top of the earlier
+// messages and records it
+func (ctx *txContext) debit(denom, account string, amount Amount) error {
+	key := balanceKey(denom, account)
+	total, err := ctx.debits[key].Add(amount)
+	if err != nil || balanceOf(denom, account).Cmp(total) < 0 {
+		return apperrors.ErrInsufficientFunds.Wrapf("account %s has %s %s, needs %s", account, balanceOf(denom, account), denom, total)
+	}
+	ctx.debits[key] = total
+	return nil
+}
+
+func isValidTransfer(transfer *Transfer, ctx *txContext) error {
+	if _, ok := keyMap[transfer.Dest]; !ok {
+		return apperrors.ErrUnknownRecipient.Wrapf("%q", transfer.Dest)
+	}
+	decimals, ok := denomDecimals(transfer.denom())
+	if !ok {
+		return apperrors.ErrUnknownDenom.Wrapf("%q", transfer.denom())
+	}
+	amount, err := ParsePositiveAmount(transfer.Amount, decimals)
+	if err != nil {
+		return apperrors.ErrInvalidAmount.Wrapf("%q: %v", transfer.Amount, err)
+	}
+	return ctx.debit(transfer.denom(), transfer.Sender, amount)
+}
+
+// verifySignature checks the message signature against the signer's key set.
+func verifySignature(msg Msg, ctx *txContext) error {
+	keySet, err := parseKeySet(keyMap[msg.Signer()])
+	if err != nil {
+		return apperrors.ErrInvalidPubKey.Wrapf("account %s", msg.Signer())
+	}
+	if err := keySet.verify(msg.Challenge(), msg.Sig(), ctx.gas); err != nil {
+		return fmt.Errorf("signer %s: %w", msg.Signer(), err)
+	}
+	return nil
 }
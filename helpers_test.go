@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+// accountKeys holds the private keys of the accounts of the test genesis, the
+// built-in accounts 1 and 2 of the README
+var accountKeys = map[string]string{
+	"1": "23e980b97c67af9b94319b6672049fbd2f9992eaf6a567a2b5a66286e527e8e9c8af5ee74756bb934c9c3f93a3ffa4125c93d8a76619a1834f4511334d83d45f",
+	"2": "11a2070b5bf25002c43d238117840fb97492266d3e0fb7637b069d5569b5d8283382d764d3e30ce4c3aab066335a558e8f632d2aaf161e6aa5615c57176cfbca",
+}
+
+// testGenesis returns the InitChain request of a chain where both accounts of
+// accountKeys hold 1000
+func testGenesis(t *testing.T) *abcitypes.InitChainRequest {
+	t.Helper()
+	genesis := GenesisState{}
+	for _, id := range sortedKeys(accountKeys) {
+		key, _ := hex.DecodeString(accountKeys[id])
+		genesis.Accounts = append(genesis.Accounts, GenesisAccount{
+			Id:      id,
+			PubKey:  hex.EncodeToString(ed25519.PrivateKey(key).Public().(ed25519.PublicKey)),
+			Balance: "1000",
+		})
+	}
+	appState, err := json.Marshal(genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &abcitypes.InitChainRequest{ChainId: "test", AppStateBytes: appState}
+}
+
+// sign returns the signature of challenge by account
+func sign(account string, challenge []byte) string {
+	key, _ := hex.DecodeString(accountKeys[account])
+	return hex.EncodeToString(ed25519.Sign(ed25519.PrivateKey(key), challenge))
+}
+
+// transferTx returns a transaction transferring amount from sender to dest,
+// paying fee unless it is empty
+func transferTx(id, sender, dest, amount, fee string) []byte {
+	transfer := &Transfer{Id: id, Sender: sender, Dest: dest, Amount: amount}
+	tx := strings.Join([]string{id, sender, dest, amount, sign(sender, transfer.Challenge())}, "=")
+	if fee != "" {
+		f := &Fee{Payer: sender, Amount: fee, msgs: []Msg{transfer}}
+		tx += ":" + strings.Join([]string{"fee", sender, fee, sign(sender, f.Challenge())}, "=")
+	}
+	return []byte(tx)
+}
+
+// commitBlock executes and commits a block through the app
+func commitBlock(t *testing.T, app *KVStoreApplication, req *abcitypes.FinalizeBlockRequest) {
+	t.Helper()
+	ctx := context.Background()
+	res, err := app.FinalizeBlock(ctx, req)
+	if err != nil {
+		t.Fatalf("finalizing block %d: %v", req.Height, err)
+	}
+	for i, tx := range res.TxResults {
+		if tx.Code != 0 {
+			t.Fatalf("block %d: transaction %d failed: %s", req.Height, i, tx.Log)
+		}
+	}
+	if _, err := app.Commit(ctx, &abcitypes.CommitRequest{}); err != nil {
+		t.Fatalf("committing block %d: %v", req.Height, err)
+	}
+}
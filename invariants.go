@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"test/apperrors"
+)
+
+// supplyKey stores the supply counters of the native asset as JSON, those of
+// other assets are stored under supply/<denom>
+var supplyKey = []byte("supply")
+
+// Supply tracks how the total supply of an asset came about. The sum of all
+// balances, reserved amounts and stake must always equal Genesis + Minted -
+// Burned.
+type Supply struct {
+	Genesis Amount `json:"genesis"`
+	Minted  Amount `json:"minted"`
+	Burned  Amount `json:"burned"`
+}
+
+// supplyMap holds the supply counters of each denomination
+var supplyMap = map[string]Supply{}
+
+// supplyStoreKey returns the database key of the supply counters of denom
+func supplyStoreKey(denom string) string {
+	if denom == nativeDenom() {
+		return string(supplyKey)
+	}
+	return "supply/" + denom
+}
+
+// setSupply updates the supply counters of denom and writes them to the ongoing block
+func (app *KVStoreApplication) setSupply(denom string, s Supply) error {
+	journalEntry(app, supplyMap, denom)
+	supplyMap[denom] = s
+	if err := app.onGoingBlock.Set([]byte(supplyStoreKey(denom)), encodeSupply(s)); err != nil {
+		return fmt.Errorf("writing supply of %s: %w", denom, err)
+	}
+	return nil
+}
+
+// mint and burn count amount of denom as minted or burned
+func (app *KVStoreApplication) mint(denom string, amount Amount) error {
+	supply := supplyMap[denom]
+	minted, err := supply.Minted.Add(amount)
+	if err != nil {
+		return apperrors.ErrSupplyOverflow.Wrapf("minted %s", denom)
+	}
+	supply.Minted = minted
+	return app.setSupply(denom, supply)
+}
+
+func (app *KVStoreApplication) burn(denom string, amount Amount) error {
+	supply := supplyMap[denom]
+	burned, err := supply.Burned.Add(amount)
+	if err != nil {
+		return apperrors.ErrSupplyOverflow.Wrapf("burned %s", denom)
+	}
+	supply.Burned = burned
+	return app.setSupply(denom, supply)
+}
+
+func encodeSupply(s Supply) []byte {
+	value, err := json.Marshal(s)
+	if err != nil {
+		log.Panicf("Error encoding supply: %v", err)
+	}
+	return value
+}
+
+// totalSupply sums every balance, reserved amount and stake of denom, failing
+// if the sum doesn't fit in an Amount
+func totalSupply(denom string) (Amount, error) {
+	var total Amount
+	var err error
+	balances := balanceMap[denom]
+	for _, account := range sortedKeys(balances) {
+		if total, err = total.Add(balances[account]); err != nil {
+			return Amount{}, fmt.Errorf("total supply of %s overflows at the balance of account %s", denom, account)
+		}
+	}
+	// Pending transfers and stake only hold the native asset
+	if denom != nativeDenom() {
+		return total, nil
+	}
+	for _, account := range sortedKeys(reservedMap) {
+		if total, err = total.Add(reservedMap[account]); err != nil {
+			return Amount{}, fmt.Errorf("total supply of %s overflows at the reserved amount of account %s", denom, account)
+		}
+	}
+	for _, address := range sortedKeys(validatorMap) {
+		if total, err = total.Add(validatorMap[address].Stake); err != nil {
+			return Amount{}, fmt.Errorf("total supply of %s overflows at the stake of validator %s", denom, address)
+		}
+	}
+	for _, height := range sortedKeys(unbondingMap) {
+		for _, key := range sortedKeys(unbondingMap[height]) {
+			if total, err = total.Add(unbondingMap[height][key].Amount); err != nil {
+				return Amount{}, fmt.Errorf("total supply of %s overflows at unbonding %s", denom, unbondingKey(height, unbondingMap[height][key].Validator, unbondingMap[height][key].Account))
+			}
+		}
+	}
+	return total, nil
+}
+
+// defaultInvariantInterval is the number of blocks between invariant checks
+// when the invariant_interval param is unset
+const defaultInvariantInterval = 1
+
+// invariantSweepInterval returns the number of blocks between invariant
+// checks, 0 if they are disabled
+func (app *KVStoreApplication) invariantSweepInterval() int64 {
+	switch {
+	case app.invariantInterval >= 0:
+		return app.invariantInterval
+	case params.InvariantInterval > 0:
+		return params.InvariantInterval
+	}
+	return defaultInvariantInterval
+}
+
+// checkState runs the invariant checks and verifies the app hash kept up to
+// date by the blocks against a hash of the whole state
+func (app *KVStoreApplication) checkState() error {
+	if err := checkInvariants(); err != nil {
+		return err
+	}
+	if full := appHash(); !bytes.Equal(full, app.appHash) {
+		return fmt.Errorf("app hash is %X, but the state hashes to %X", app.appHash, full)
+	}
+	return nil
+}
+
+// checkInvariants verifies that no money of any asset was created or destroyed
+// outside of minting and burning, that reservations match the pending
+// transfers and that the stake of validators matches their delegations
+func checkInvariants() error {
+	denoms := map[string]bool{}
+	for denom := range supplyMap {
+		denoms[denom] = true
+	}
+	for denom := range balanceMap {
+		denoms[denom] = true
+	}
+	for _, denom := range sortedKeys(denoms) {
+		if err := checkSupply(denom); err != nil {
+			return err
+		}
+	}
+	if err := checkReserved(); err != nil {
+		return err
+	}
+	return checkStake()
+}
+
+// checkSupply verifies that the balances of denom add up to its supply counters
+func checkSupply(denom string) error {
+	supply := supplyMap[denom]
+	issued, err := supply.Genesis.Add(supply.Minted)
+	if err != nil {
+		return fmt.Errorf("supply counters of %s are inconsistent: genesis %s, minted %s: %w", denom, supply.Genesis, supply.Minted, err)
+	}
+	expected, err := issued.Sub(supply.Burned)
+	if err != nil {
+		return fmt.Errorf("supply counters of %s are inconsistent: genesis %s, minted %s, burned %s: %w",
+			denom, supply.Genesis, supply.Minted, supply.Burned, err)
+	}
+
+	total, err := totalSupply(denom)
+	if err != nil {
+		return err
+	}
+	if total != expected {
+		return fmt.Errorf("total supply of %s is %s, expected %s (genesis %s + minted %s - burned %s)",
+			denom, total, expected, supply.Genesis, supply.Minted, supply.Burned)
+	}
+	return nil
+}
+
+// checkReserved verifies that the reserved amounts match the pending transfers
+func checkReserved() error {
+	var err error
+	reserved := map[string]Amount{}
+	for _, id := range sortedKeys(pendingMap) {
+		if record := pendingMap[id]; record.Status == pendingStatusPending {
+			if reserved[record.Sender], err = reserved[record.Sender].Add(record.Amount); err != nil {
+				return fmt.Errorf("pending transfers of account %s overflow: %w", record.Sender, err)
+			}
+		}
+	}
+	for _, account := range sortedKeys(reservedMap) {
+		if reservedMap[account] != reserved[account] {
+			return fmt.Errorf("reserved amount of account %s is %s, but its pending transfers hold %s",
+				account, reservedMap[account], reserved[account])
+		}
+	}
+	for _, account := range sortedKeys(reserved) {
+		if _, ok := reservedMap[account]; !ok {
+			return fmt.Errorf("pending transfers of account %s hold %s, but nothing is reserved", account, reserved[account])
+		}
+	}
+	return nil
+}
+
+// checkStake verifies that the stake of each validator is the sum of its
+// delegations
+func checkStake() error {
+	for _, address := range sortedKeys(validatorMap) {
+		var total Amount
+		var err error
+		for _, account := range sortedKeys(delegationMap[address]) {
+			if total, err = total.Add(delegationMap[address][account]); err != nil {
+				return fmt.Errorf("delegations of validator %s overflow: %w", address, err)
+			}
+		}
+		if stake := validatorMap[address].Stake; stake != total {
+			return fmt.Errorf("stake of validator %s is %s, but its delegations hold %s", address, stake, total)
+		}
+	}
+	for _, address := range sortedKeys(delegationMap) {
+		if _, ok := validatorMap[address]; !ok {
+			return fmt.Errorf("delegations to unknown validator %s", address)
+		}
+	}
+	return nil
+}
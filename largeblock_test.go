@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"test/db"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	"github.com/dgraph-io/badger/v4"
+)
+
+// largeBlockPending is the number of genesis pending transfers expired by the
+// first block, whose records don't fit in one Badger transaction with the
+// default options
+const largeBlockPending = 100_000
+
+// largeBlockOptions are Badger's default options, with quieter logs
+var largeBlockOptions = db.BadgerOptions{LogLevel: "error"}
+
+func largeBlockGenesis(t *testing.T, expiresAt int64) *abcitypes.InitChainRequest {
+	t.Helper()
+	genesis := testGenesis(t)
+	var state GenesisState
+	if err := json.Unmarshal(genesis.AppStateBytes, &state); err != nil {
+		t.Fatal(err)
+	}
+	state.Accounts[0].Balance = "0"
+	for i := 1; i <= largeBlockPending; i++ {
+		state.PendingTransfers = append(state.PendingTransfers, GenesisPendingTransfer{
+			Id: strconv.Itoa(i),
+			pendingRecord: pendingRecord{
+				Sender:    "1",
+				Dest:      "2",
+				Amount:    NewAmount(1),
+				ExpiresAt: expiresAt,
+				Status:    pendingStatusPending,
+			},
+		})
+	}
+	appState, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis.AppStateBytes = appState
+	return genesis
+}
+
+func TestBadgerLargeBlockSurvivesReopen(t *testing.T) {
+	if testing.Short() {
+		t.Skip("commits a large block")
+	}
+	blockTime := time.Unix(1_700_000_000, 0)
+
+	// The block must not fit in a single Badger transaction
+	sizing, err := badger.Open(badger.DefaultOptions(t.TempDir()).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn := sizing.NewTransaction(true)
+	record := encodePendingRecord(&pendingRecord{Sender: "1", Dest: "2", Amount: NewAmount(1), ExpiresAt: blockTime.Unix(), Status: pendingStatusExpired})
+	tooBig := false
+	for i := 1; i <= largeBlockPending && !tooBig; i++ {
+		tooBig = errors.Is(txn.Set([]byte(fmt.Sprintf("pending/%d", i)), record), badger.ErrTxnTooBig)
+	}
+	txn.Discard()
+	sizing.Close()
+	if !tooBig {
+		t.Fatal("the block fits in a single transaction")
+	}
+
+	dir := t.TempDir()
+	database, err := db.NewBadgerDB(dir, largeBlockOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err := NewKVStoreApplication(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := app.InitChain(ctx, largeBlockGenesis(t, blockTime.Unix())); err != nil {
+		t.Fatal(err)
+	}
+	res, err := app.FinalizeBlock(ctx, &abcitypes.FinalizeBlockRequest{Height: 1, Time: blockTime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Events) < largeBlockPending {
+		t.Fatalf("%d events, want the %d pending transfers to expire", len(res.Events), largeBlockPending)
+	}
+	if _, err := app.Commit(ctx, &abcitypes.CommitRequest{}); err != nil {
+		t.Fatalf("committing a large block: %v", err)
+	}
+	if err := database.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	database, err = db.NewBadgerDB(dir, largeBlockOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	app, err = NewKVStoreApplication(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := app.Info(ctx, &abcitypes.InfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.LastBlockHeight != 1 || !bytes.Equal(info.LastBlockAppHash, res.AppHash) {
+		t.Fatalf("reopened at height %d with app hash %X, want height 1 and %X", info.LastBlockHeight, info.LastBlockAppHash, res.AppHash)
+	}
+	if !bytes.Equal(info.LastBlockAppHash, appHash()) {
+		t.Fatalf("app hash %X does not match the reopened state %X", info.LastBlockAppHash, appHash())
+	}
+	if got, want := balanceOf(nativeDenom(), "1"), NewAmount(largeBlockPending); got != want {
+		t.Fatalf("balance of account 1 is %s, want %s", got, want)
+	}
+	for id, record := range pendingMap {
+		if record.Status != pendingStatusExpired {
+			t.Fatalf("pending transfer %s is %s after reopening, want %s", id, record.Status, pendingStatusExpired)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+// lockDatabase is a no-op on platforms without flock, where a running node's
+// database is only protected by the backend's own locking.
+func lockDatabase(dbPath string) (func(), error) {
+	return func() {}, nil
+}
@@ -9,6 +9,7 @@ import (
 	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
 
 	"github.com/cometbft/cometbft/p2p"
 	"github.com/cometbft/cometbft/privval"
@@ -29,6 +30,19 @@ var (
 	dbPath      string
 	tbAddresses string
 	tbClusterID uint
+
+	dbPreset       string
+	dbCacheSize    int64
+	dbMemTableSize int64
+	dbCompression  string
+	dbDurability   string
+	dbSyncEvery    int
+
+	dbMaintenanceInterval time.Duration
+
+	invariantInterval int64
+
+	oracleFeed string
 )
 
 func init() {
@@ -36,9 +50,29 @@ func init() {
 	flag.StringVar(&dbType, "db-type", "badger", "Database type: badger, pebble, or tigerbeetle")
 	flag.StringVar(&dbPath, "db-path", "", "Path to the database")
 	flag.StringVar(&tbAddresses, "tb-addresses", "3000", "TigerBeetle addresses (comma-separated)")
+	flag.StringVar(&dbPreset, "db-preset", "", "Database tuning preset: default, throughput, durability, or low-memory")
+	flag.Int64Var(&dbCacheSize, "db-cache-size", 0, "Database block cache size in bytes (overrides the preset)")
+	flag.Int64Var(&dbMemTableSize, "db-memtable-size", 0, "Database memtable size in bytes (overrides the preset)")
+	flag.StringVar(&dbCompression, "db-compression", "", "Database compression: none, snappy, or zstd (overrides the preset)")
+	flag.StringVar(&dbDurability, "db-durability", "", "Block commit durability: sync, group, or none (overrides the preset)")
+	flag.IntVar(&dbSyncEvery, "db-sync-every", 0, "Number of blocks per sync with group durability (overrides the preset)")
+	flag.Int64Var(&invariantInterval, "invariant-interval", -1, "Number of blocks between supply invariant checks, overriding the invariant_interval genesis param (0 disables them)")
+	flag.StringVar(&oracleFeed, "oracle-feed", "", "File or HTTP URL of the JSON prices attached to this validator's votes (if empty, none)")
+	flag.DurationVar(&dbMaintenanceInterval, "db-maintenance-interval", 10*time.Minute, "Interval between value-log GC or compaction runs (0 disables them)")
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			runMigrate(os.Args[2:])
+			return
+		case "export":
+			runExport(os.Args[2:])
+			return
+		}
+	}
+
 	flag.Parse()
 	if homeDir == "" {
 		homeDir = os.ExpandEnv("$HOME/.cometbft")
@@ -54,6 +88,12 @@ func main() {
 	if os.Getenv("TB_ADDRESSES") != "" && tbAddresses == "3000" {
 		tbAddresses = os.Getenv("TB_ADDRESSES")
 	}
+	if os.Getenv("DB_PRESET") != "" && dbPreset == "" {
+		dbPreset = os.Getenv("DB_PRESET")
+	}
+	if os.Getenv("DB_DURABILITY") != "" && dbDurability == "" {
+		dbDurability = os.Getenv("DB_DURABILITY")
+	}
 
 	// get ID from environment variable
 	// nodeID := os.Getenv("ID")
@@ -74,30 +114,36 @@ func main() {
 	}
 
 	// Initialize the appropriate database
-	var database db.DB
-	var err error
-
 	if dbPath == "" {
 		dbPath = filepath.Join(homeDir, dbType)
 	}
 
-	switch dbType {
-	case "badger", "":
-		database, err = db.NewBadgerDB(dbPath)
-	case "pebble":
-		database, err = db.NewPebbleDB(dbPath)
-	case "tigerbeetle":
-		database, err = db.NewTigerBeetleDBFromMain(tbAddresses)
-	default:
-		log.Fatalf("Unknown database type: %s", dbType)
+	unlock, err := lockDatabase(dbPath)
+	if err != nil {
+		log.Fatalf("Failed to lock database: %v", err)
 	}
+	defer unlock()
 
+	database, err := openDatabase(dbType, dbPath)
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 	defer database.Close()
 
-	app := NewKVStoreApplication(database)
+	if !isFlagSet("db-maintenance-interval") && viper.IsSet("db.maintenance_interval") {
+		dbMaintenanceInterval = viper.GetDuration("db.maintenance_interval")
+	}
+	maintenance := db.NewScheduler(database, dbMaintenanceInterval)
+	maintenance.Start()
+	defer maintenance.Stop()
+
+	app, err := NewKVStoreApplication(database)
+	if err != nil {
+		log.Fatalf("Failed to initialize application: %v", err)
+	}
+	app.maintenance = maintenance
+	app.invariantInterval = invariantInterval
+	app.oracleFeed = oracleFeed
 
 	pv := privval.LoadFilePV(
 		config.PrivValidatorKeyFile(),
@@ -142,3 +188,113 @@ func main() {
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
 }
+
+// openDatabase opens a database of the given type
+func openDatabase(dbType, dbPath string) (db.DB, error) {
+	switch dbType {
+	case "badger", "":
+		opts, err := badgerOptions()
+		if err != nil {
+			return nil, err
+		}
+		return db.NewBadgerDB(dbPath, opts)
+	case "pebble":
+		opts, err := pebbleOptions()
+		if err != nil {
+			return nil, err
+		}
+		return db.NewPebbleDB(dbPath, opts)
+	case "tigerbeetle":
+		opts, err := pebbleOptions()
+		if err != nil {
+			return nil, err
+		}
+		return db.NewTigerBeetleDBFromMain(tbAddresses, dbPath, opts)
+	}
+	return nil, fmt.Errorf("unknown database type: %s", dbType)
+}
+
+// isFlagSet reports whether the named flag was given on the command line
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// presetName returns the database tuning preset from the flags or the config file
+func presetName() string {
+	if dbPreset != "" {
+		return dbPreset
+	}
+	return viper.GetString("db.preset")
+}
+
+// badgerOptions resolves the Badger tuning options: the preset first, then the
+// [db.badger] table of the config file, then the command line flags.
+func badgerOptions() (db.BadgerOptions, error) {
+	opts, err := db.BadgerPreset(presetName())
+	if err != nil {
+		return opts, err
+	}
+	if err := viper.UnmarshalKey("db.badger", &opts); err != nil {
+		return opts, err
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "db-cache-size":
+			opts.BlockCacheSize = dbCacheSize
+		case "db-memtable-size":
+			opts.MemTableSize = dbMemTableSize
+		case "db-compression":
+			opts.Compression = dbCompression
+		}
+	})
+	opts.DurabilityOptions = durabilityOptions(opts.DurabilityOptions)
+	return opts, nil
+}
+
+// pebbleOptions resolves the Pebble tuning options: the preset first, then the
+// [db.pebble] table of the config file, then the command line flags.
+func pebbleOptions() (db.PebbleOptions, error) {
+	opts, err := db.PebblePreset(presetName())
+	if err != nil {
+		return opts, err
+	}
+	if err := viper.UnmarshalKey("db.pebble", &opts); err != nil {
+		return opts, err
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "db-cache-size":
+			opts.CacheSize = dbCacheSize
+		case "db-memtable-size":
+			opts.MemTableSize = uint64(dbMemTableSize)
+		case "db-compression":
+			opts.Compression = dbCompression
+		}
+	})
+	opts.DurabilityOptions = durabilityOptions(opts.DurabilityOptions)
+	return opts, nil
+}
+
+// durabilityOptions applies the durability settings shared by every backend,
+// from the [db] table of the config file and then the command line flags
+func durabilityOptions(opts db.DurabilityOptions) db.DurabilityOptions {
+	if viper.IsSet("db.durability") {
+		opts.Durability = db.Durability(viper.GetString("db.durability"))
+	}
+	if viper.IsSet("db.sync_every") {
+		opts.SyncEvery = viper.GetInt("db.sync_every")
+	}
+	if dbDurability != "" {
+		opts.Durability = db.Durability(dbDurability)
+	}
+	if dbSyncEvery != 0 {
+		opts.SyncEvery = dbSyncEvery
+	}
+	return opts
+}
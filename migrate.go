@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"test/db"
+)
+
+// migrateBatchSize is the number of keys written per destination transaction
+const migrateBatchSize = 10000
+
+// runMigrate implements the migrate subcommand, which copies the app state
+// from one database backend to another and checks that the app hash of the
+// copy matches the source.
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fromType := fs.String("from-type", "", "Source database type: badger, pebble, or tigerbeetle")
+	fromPath := fs.String("from-path", "", "Path to the source database")
+	toType := fs.String("to-type", "", "Destination database type: badger, pebble, or tigerbeetle")
+	toPath := fs.String("to-path", "", "Path to the destination database, which must be empty")
+	fs.StringVar(&tbAddresses, "tb-addresses", "3000", "TigerBeetle addresses (comma-separated)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s migrate -from-type TYPE -from-path PATH -to-type TYPE -to-path PATH\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *fromType == "" || *toType == "" || *fromPath == "" || *toPath == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *fromType == *toType && *fromPath == *toPath {
+		log.Fatalf("Source and destination are the same database")
+	}
+
+	if err := migrate(*fromType, *fromPath, *toType, *toPath); err != nil {
+		log.Fatalf("Migration failed: %v", err)
+	}
+}
+
+func migrate(fromType, fromPath, toType, toPath string) error {
+	// A running node holds the lock of its database for its whole lifetime
+	for _, path := range []string{fromPath, toPath} {
+		unlock, err := lockDatabase(path)
+		if err != nil {
+			return fmt.Errorf("refusing to migrate: %w", err)
+		}
+		defer unlock()
+	}
+
+	src, err := openDatabase(fromType, fromPath)
+	if err != nil {
+		return fmt.Errorf("opening source: %w", err)
+	}
+	defer src.Close()
+
+	dst, err := openDatabase(toType, toPath)
+	if err != nil {
+		return fmt.Errorf("opening destination: %w", err)
+	}
+	defer dst.Close()
+
+	errNotEmpty := errors.New("destination database is not empty")
+	if err := dst.Iterate(nil, func(key, value []byte) error { return errNotEmpty }); err != nil {
+		return err
+	}
+
+	copied, err := copyState(src, dst)
+	if err != nil {
+		return err
+	}
+
+	srcEntries, err := dbStateEntries(src)
+	if err != nil {
+		return fmt.Errorf("reading source state: %w", err)
+	}
+	dstEntries, err := dbStateEntries(dst)
+	if err != nil {
+		return fmt.Errorf("reading destination state: %w", err)
+	}
+	srcHash, dstHash := hashState(srcEntries), hashState(dstEntries)
+
+	if recorded, err := src.Get(appHashKey); err == nil && !bytes.Equal(recorded, srcHash) {
+		return fmt.Errorf("source state hash %X does not match its recorded app hash %X", srcHash, recorded)
+	}
+	if !bytes.Equal(srcHash, dstHash) {
+		return fmt.Errorf("destination app hash %X does not match source app hash %X (%d of %d keys copied)",
+			dstHash, srcHash, len(dstEntries), len(srcEntries))
+	}
+
+	fmt.Printf("Migrated %d keys from %s to %s, app hash %X\n", copied, fromType, toType, dstHash)
+	return nil
+}
+
+// copyState writes every key of src into dst, including the app metadata so
+// that the destination resumes at the same height. Open pending transfers are
+// also created on a destination that supports them natively, so that they can
+// be posted or voided after the migration.
+func copyState(src, dst db.DB) (int, error) {
+	tx, err := dst.BeginTx()
+	if err != nil {
+		return 0, err
+	}
+	copied, batched := 0, 0
+	err = src.Iterate(nil, func(key, value []byte) error {
+		if err := tx.Set(key, value); err != nil {
+			return err
+		}
+		if err := copyNativePending(tx, key, value); err != nil {
+			return err
+		}
+		copied++
+		if batched++; batched < migrateBatchSize {
+			return nil
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		batched = 0
+		tx, err = dst.BeginTx()
+		return err
+	})
+	if err != nil {
+		tx.Rollback()
+		return copied, fmt.Errorf("copying state: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return copied, fmt.Errorf("copying state: %w", err)
+	}
+	return copied, nil
+}
+
+// copyNativePending creates the pending transfer stored under key on tx if it
+// is still open and tx supports pending transfers natively
+func copyNativePending(tx db.Transaction, key, value []byte) error {
+	ledger, ok := tx.(db.PendingTransfers)
+	id, isPending := strings.CutPrefix(string(key), "pending/")
+	if !ok || !isPending {
+		return nil
+	}
+	var record pendingRecord
+	if err := json.Unmarshal(value, &record); err != nil {
+		return fmt.Errorf("invalid pending transfer %s: %w", id, err)
+	}
+	if record.Status != pendingStatusPending {
+		return nil
+	}
+	return createNativePending(ledger, id, &record)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"test/apperrors"
+)
+
+// maxMultisigKeys bounds the signature verifications of a multisig account
+const maxMultisigKeys = 16
+
+// KeySet is the public key of an account: a single ed25519 key, encoded as
+// hex, or M of N keys, encoded as <threshold>/<key>,<key>,...
+type KeySet struct {
+	Threshold int
+	Keys      []ed25519.PublicKey
+}
+
+// parseKeySet decodes and checks the public key of an account
+func parseKeySet(s string) (KeySet, error) {
+	thresholdPart, keysPart, multisig := strings.Cut(s, "/")
+	if !multisig {
+		key, err := parsePubKey(s)
+		if err != nil {
+			return KeySet{}, err
+		}
+		return KeySet{Threshold: 1, Keys: []ed25519.PublicKey{key}}, nil
+	}
+
+	hexKeys := strings.Split(keysPart, ",")
+	if len(hexKeys) > maxMultisigKeys {
+		return KeySet{}, fmt.Errorf("%d keys exceed the maximum of %d", len(hexKeys), maxMultisigKeys)
+	}
+	threshold, err := strconv.Atoi(thresholdPart)
+	if err != nil || strconv.Itoa(threshold) != thresholdPart || threshold < 1 || threshold > len(hexKeys) {
+		return KeySet{}, fmt.Errorf("invalid threshold %q for %d keys", thresholdPart, len(hexKeys))
+	}
+	keySet := KeySet{Threshold: threshold}
+	seen := map[string]bool{}
+	for _, hexKey := range hexKeys {
+		key, err := parsePubKey(hexKey)
+		if err != nil {
+			return KeySet{}, err
+		}
+		if seen[string(key)] {
+			return KeySet{}, fmt.Errorf("duplicate key %s", hexKey)
+		}
+		seen[string(key)] = true
+		keySet.Keys = append(keySet.Keys, key)
+	}
+	return keySet, nil
+}
+
+// parsePubKey decodes a hex ed25519 public key
+func parsePubKey(s string) (ed25519.PublicKey, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid ed25519 public key %q", s)
+	}
+	return key, nil
+}
+
+// verify checks signature against the key set. A multisig signature has one
+// comma-separated entry per key, in the order of the keys, left empty for the
+// keys that didn't sign. Every entry present must be valid, and costs gas
+// before it is verified.
+func (k KeySet) verify(challenge []byte, signature string, gas *GasMeter) error {
+	if len(k.Keys) == 1 {
+		if err := gas.Consume(gasPerSignature); err != nil {
+			return err
+		}
+		signatureBytes, err := hex.DecodeString(signature)
+		if err != nil {
+			return apperrors.ErrInvalidSignature.Wrapf("%v", err)
+		}
+		if !ed25519.Verify(k.Keys[0], challenge, signatureBytes) {
+			return apperrors.ErrBadSignature
+		}
+		return nil
+	}
+	entries := strings.Split(signature, ",")
+	if len(entries) != len(k.Keys) {
+		return apperrors.ErrInvalidSignature.Wrapf("%d signatures for %d keys", len(entries), len(k.Keys))
+	}
+	signed := 0
+	for i, entry := range entries {
+		if entry == "" {
+			continue
+		}
+		if err := gas.Consume(gasPerSignature); err != nil {
+			return err
+		}
+		signatureBytes, err := hex.DecodeString(entry)
+		if err != nil {
+			return apperrors.ErrInvalidSignature.Wrapf("signature %d: %v", i, err)
+		}
+		if !ed25519.Verify(k.Keys[i], challenge, signatureBytes) {
+			return apperrors.ErrBadSignature.Wrapf("signature %d", i)
+		}
+		signed++
+	}
+	if signed < k.Threshold {
+		return apperrors.ErrBadSignature.Wrapf("%d of the %d signatures required", signed, k.Threshold)
+	}
+	return nil
+}
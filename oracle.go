@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"test/apperrors"
+	"test/db"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	cmtproto "github.com/cometbft/cometbft/api/cometbft/types/v1"
+	cmttypes "github.com/cometbft/cometbft/types"
+)
+
+// oracleTxPrefix starts the transaction a proposer puts first in its block to
+// carry the vote extensions of the previous height, followed by the protobuf
+// encoded ExtendedCommitInfo
+var oracleTxPrefix = []byte("oracle=")
+
+// chainIDKey stores the chain id, which vote extension signatures cover
+var chainIDKey = []byte("meta/chain_id")
+
+const (
+	// priceDecimals is the number of fractional digits of oracle prices
+	priceDecimals = 18
+	// maxOraclePairs bounds the prices of a vote extension
+	maxOraclePairs = 32
+	// oracleFeedTimeout bounds the time ExtendVote waits for an HTTP feed
+	oracleFeedTimeout = time.Second
+)
+
+// pairPattern restricts price pairs to a base and quote symbol such as BTC/USD
+var pairPattern = regexp.MustCompile(`^[A-Z0-9]{2,12}/[A-Z0-9]{2,12}$`)
+
+// OracleVote is the vote extension of a validator: the prices of its feed
+// when it voted for the block at Height
+type OracleVote struct {
+	Height int64             `json:"height"`
+	Prices map[string]string `json:"prices"`
+}
+
+// PriceRecord is the median price of a pair, stored under price/<pair>
+type PriceRecord struct {
+	Price string `json:"price"`
+	// Height is the block the price was voted for
+	Height int64 `json:"height"`
+	// Votes is the number of validators that quoted the pair
+	Votes int `json:"votes"`
+}
+
+// priceMap holds the latest median price of each pair
+var priceMap = map[string]PriceRecord{}
+
+// readOracleFeed reads the prices of a feed, a JSON object of prices by pair
+// served over HTTP or stored in a local file
+func readOracleFeed(source string) (map[string]json.Number, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		client := http.Client{Timeout: oracleFeedTimeout}
+		resp, err := client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("feed returned %s", resp.Status)
+		}
+		if data, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20)); err != nil {
+			return nil, err
+		}
+	} else if data, err = os.ReadFile(source); err != nil {
+		return nil, err
+	}
+
+	var prices map[string]json.Number
+	if err := json.Unmarshal(data, &prices); err != nil {
+		return nil, fmt.Errorf("decoding feed: %w", err)
+	}
+	return prices, nil
+}
+
+// oracleVote returns the vote extension for height, empty if the node has no
+// feed or it can't be read. Invalid prices are left out.
+func (app *KVStoreApplication) oracleVote(height int64) []byte {
+	if app.oracleFeed == "" {
+		return nil
+	}
+	feed, err := readOracleFeed(app.oracleFeed)
+	if err != nil {
+		log.Printf("Reading oracle feed %s: %v", app.oracleFeed, err)
+		return nil
+	}
+	vote := OracleVote{Height: height, Prices: map[string]string{}}
+	for _, pair := range sortedKeys(feed) {
+		if len(vote.Prices) == maxOraclePairs {
+			log.Printf("Oracle feed %s has more than %d pairs, ignoring the others", app.oracleFeed, maxOraclePairs)
+			break
+		}
+		if err := validPrice(pair, feed[pair].String()); err != nil {
+			log.Printf("Ignoring oracle price of %s: %v", pair, err)
+			continue
+		}
+		vote.Prices[pair] = feed[pair].String()
+	}
+	if len(vote.Prices) == 0 {
+		return nil
+	}
+	extension, err := json.Marshal(vote)
+	if err != nil {
+		log.Printf("Encoding oracle vote: %v", err)
+		return nil
+	}
+	return extension
+}
+
+func validPrice(pair, price string) error {
+	if !pairPattern.MatchString(pair) {
+		return fmt.Errorf("invalid pair %q", pair)
+	}
+	if _, err := ParsePositiveAmount(price, priceDecimals); err != nil {
+		return fmt.Errorf("invalid price %q: %w", price, err)
+	}
+	return nil
+}
+
+// parseOracleVote decodes the vote extension of a validator for height, nil if
+// it is empty
+func parseOracleVote(extension []byte, height int64) (*OracleVote, error) {
+	if len(extension) == 0 {
+		return nil, nil
+	}
+	var vote OracleVote
+	decoder := json.NewDecoder(bytes.NewReader(extension))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&vote); err != nil {
+		return nil, fmt.Errorf("decoding oracle vote: %w", err)
+	}
+	if vote.Height != height {
+		return nil, fmt.Errorf("oracle vote is for height %d, not %d", vote.Height, height)
+	}
+	if len(vote.Prices) == 0 || len(vote.Prices) > maxOraclePairs {
+		return nil, fmt.Errorf("oracle vote has %d prices, expected 1 to %d", len(vote.Prices), maxOraclePairs)
+	}
+	for pair, price := range vote.Prices {
+		if err := validPrice(pair, price); err != nil {
+			return nil, err
+		}
+	}
+	return &vote, nil
+}
+
+func isOracleTx(tx []byte) bool {
+	return bytes.HasPrefix(tx, oracleTxPrefix)
+}
+
+// oracleTx returns the transaction carrying the vote extensions of the last
+// commit, nil if none of them holds prices
+func oracleTx(commit abcitypes.ExtendedCommitInfo) []byte {
+	for _, vote := range commit.Votes {
+		if len(vote.VoteExtension) > 0 {
+			data, err := commit.Marshal()
+			if err != nil {
+				log.Printf("Encoding vote extensions: %v", err)
+				return nil
+			}
+			return append(bytes.Clone(oracleTxPrefix), data...)
+		}
+	}
+	return nil
+}
+
+func decodeOracleTx(tx []byte) (*abcitypes.ExtendedCommitInfo, error) {
+	var commit abcitypes.ExtendedCommitInfo
+	if err := commit.Unmarshal(bytes.TrimPrefix(tx, oracleTxPrefix)); err != nil {
+		return nil, apperrors.ErrTxDecode.Wrapf("oracle transaction: %v", err)
+	}
+	return &commit, nil
+}
+
+// verifyOracleTx checks the vote extensions a proposer put in the block at
+// height: every vote for the previous block must carry a valid extension
+// signed by a validator of the set that signed it, and the votes must hold
+// more than two thirds of its voting power, so that the proposer can't pick
+// the prices it aggregates.
+func (app *KVStoreApplication) verifyOracleTx(tx []byte, height int64) error {
+	commit, err := decodeOracleTx(tx)
+	if err != nil {
+		return err
+	}
+	set := signingSet(height - 1)
+	if set == nil {
+		return fmt.Errorf("validator set of height %d is unknown", height-1)
+	}
+	var committed int64
+	seen := map[string]bool{}
+	for _, vote := range commit.Votes {
+		address := strings.ToUpper(hex.EncodeToString(vote.Validator.Address))
+		validator, ok := set[address]
+		if !ok {
+			return fmt.Errorf("vote of validator %s, which didn't sign height %d", address, height-1)
+		}
+		if vote.Validator.Power != validator.Power {
+			return fmt.Errorf("vote of validator %s has power %d, not %d", address, vote.Validator.Power, validator.Power)
+		}
+		if seen[address] {
+			return fmt.Errorf("duplicate vote of validator %s", address)
+		}
+		seen[address] = true
+
+		if vote.BlockIdFlag != cmtproto.BlockIDFlagCommit {
+			if len(vote.VoteExtension) > 0 || len(vote.ExtensionSignature) > 0 {
+				return fmt.Errorf("validator %s has an extension without voting for the block", address)
+			}
+			continue
+		}
+		if _, err := parseOracleVote(vote.VoteExtension, height-1); err != nil {
+			return fmt.Errorf("validator %s: %w", address, err)
+		}
+		pubKey, err := hex.DecodeString(validator.PubKey)
+		if err != nil {
+			return fmt.Errorf("validator %s: invalid public key: %w", address, err)
+		}
+		signBytes := cmttypes.VoteExtensionSignBytes(app.chainID, &cmtproto.Vote{
+			Extension: vote.VoteExtension,
+			Height:    height - 1,
+			Round:     commit.Round,
+		})
+		if !ed25519.Verify(pubKey, signBytes, vote.ExtensionSignature) {
+			return fmt.Errorf("validator %s: invalid vote extension signature", address)
+		}
+		committed += validator.Power
+	}
+	var total int64
+	for _, validator := range set {
+		total += validator.Power
+	}
+	if committed*3 <= total*2 {
+		return fmt.Errorf("votes hold %d of %d voting power, not more than two thirds", committed, total)
+	}
+	return nil
+}
+
+// priceQuote is the price of a pair quoted by validators holding power
+type priceQuote struct {
+	price Amount
+	power int64
+}
+
+// medianPrice returns the power weighted median of quotes: the lowest price
+// quoted or exceeded by validators holding at least half of their power
+func medianPrice(quotes []priceQuote) Amount {
+	sort.Slice(quotes, func(i, j int) bool { return quotes[i].price.Cmp(quotes[j].price) < 0 })
+	var total, cumulative int64
+	for _, quote := range quotes {
+		total += quote.power
+	}
+	for _, quote := range quotes {
+		if cumulative += quote.power; cumulative*2 >= total {
+			return quote.price
+		}
+	}
+	return quotes[len(quotes)-1].price
+}
+
+// executeOracleTx writes the median of the prices voted for the previous
+// block, weighted by the power of the set that signed it. ProcessProposal has
+// verified the votes.
+func (app *KVStoreApplication) executeOracleTx(tx []byte, height int64) (*abcitypes.ExecTxResult, error) {
+	commit, err := decodeOracleTx(tx)
+	if err != nil {
+		codespace, code, log := apperrors.ABCIInfo(err)
+		return &abcitypes.ExecTxResult{Codespace: codespace, Code: code, Log: log}, nil
+	}
+
+	set := signingSet(height - 1)
+	quotes := map[string][]priceQuote{}
+	for _, vote := range commit.Votes {
+		validator, ok := set[strings.ToUpper(hex.EncodeToString(vote.Validator.Address))]
+		if !ok || validator.Power <= 0 || vote.BlockIdFlag != cmtproto.BlockIDFlagCommit {
+			continue
+		}
+		oracleVote, err := parseOracleVote(vote.VoteExtension, height-1)
+		if err != nil || oracleVote == nil {
+			continue
+		}
+		for pair, price := range oracleVote.Prices {
+			amount, err := ParseAmount(price, priceDecimals)
+			if err != nil {
+				continue
+			}
+			quotes[pair] = append(quotes[pair], priceQuote{price: amount, power: validator.Power})
+		}
+	}
+
+	result := &abcitypes.ExecTxResult{}
+	for _, pair := range sortedKeys(quotes) {
+		record := PriceRecord{
+			Price:  medianPrice(quotes[pair]).Format(priceDecimals),
+			Height: height - 1,
+			Votes:  len(quotes[pair]),
+		}
+		if err := app.setPrice(pair, record); err != nil {
+			return nil, err
+		}
+		result.Events = append(result.Events, abcitypes.Event{
+			Type: "oracle_price",
+			Attributes: []abcitypes.EventAttribute{
+				{Key: "pair", Value: pair, Index: true},
+				{Key: "price", Value: record.Price, Index: false},
+				{Key: "votes", Value: fmt.Sprint(record.Votes), Index: false},
+			},
+		})
+	}
+	return result, nil
+}
+
+// setPrice updates the price of a pair and writes it to the ongoing block
+func (app *KVStoreApplication) setPrice(pair string, record PriceRecord) error {
+	journalEntry(app, priceMap, pair)
+	priceMap[pair] = record
+	if err := app.onGoingBlock.Set([]byte("price/"+pair), encodePriceRecord(record)); err != nil {
+		return fmt.Errorf("writing price of %s: %w", pair, err)
+	}
+	return nil
+}
+
+func encodePriceRecord(record PriceRecord) []byte {
+	value, err := json.Marshal(record)
+	if err != nil {
+		log.Panicf("Error encoding price: %v", err)
+	}
+	return value
+}
+
+// setChainID records the chain id in the ongoing block
+func (app *KVStoreApplication) setChainID(chainID string) error {
+	app.chainID = chainID
+	if err := app.onGoingBlock.Set(chainIDKey, []byte(chainID)); err != nil {
+		return fmt.Errorf("writing chain id: %w", err)
+	}
+	return nil
+}
+
+// loadChainID restores the chain id written at InitChain
+func (app *KVStoreApplication) loadChainID() error {
+	value, err := app.db.Get(chainIDKey)
+	if errors.Is(err, db.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	app.chainID = string(value)
+	return nil
+}
+
+// queryPrices returns the latest price of every pair by pair
+func (app *KVStoreApplication) queryPrices() (*abcitypes.QueryResponse, error) {
+	prices := map[string]json.RawMessage{}
+	err := app.db.Iterate([]byte("price/"), func(key, value []byte) error {
+		prices[strings.TrimPrefix(string(key), "price/")] = value
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading prices: %w", err)
+	}
+	value, err := json.Marshal(prices)
+	if err != nil {
+		return nil, fmt.Errorf("encoding prices: %w", err)
+	}
+	return &abcitypes.QueryResponse{Log: "exists", Value: value}, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// paramsKey stores the chain parameters as JSON
+var paramsKey = []byte("params")
+
+// Params are the chain parameters, set at genesis.
+type Params struct {
+	// Denom is the denomination of the native asset, defaultDenom if empty
+	Denom string `json:"denom,omitempty"`
+	// Decimals is the number of fractional digits of native amounts. An
+	// amount of "1.5" is 15 base units with 1 decimal, balances are stored in
+	// base units.
+	Decimals uint8 `json:"decimals,omitempty"`
+	// MinFee is the smallest fee in native base units a transaction must pay
+	MinFee *Amount `json:"min_fee,omitempty"`
+	// FeeCollector is the account credited with fees, or "proposer" for the
+	// account of the block proposer. Fees are burned if it names no account.
+	FeeCollector string `json:"fee_collector,omitempty"`
+	// MaxTxGas caps the gas limit of a transaction, 0 for no cap
+	MaxTxGas uint64 `json:"max_tx_gas,omitempty"`
+	// ValidatorAccounts maps validator addresses in upper case hex to the
+	// accounts of their operators
+	ValidatorAccounts map[string]string `json:"validator_accounts,omitempty"`
+	// Admin is the account allowed to change the validator set, none if empty
+	Admin string `json:"admin,omitempty"`
+	// PowerReduction is the stake in native base units worth one unit of
+	// voting power, one whole native unit if unset
+	PowerReduction *Amount `json:"power_reduction,omitempty"`
+	// UnbondingBlocks is the number of blocks unbonded stake stays locked
+	UnbondingBlocks int64 `json:"unbonding_blocks,omitempty"`
+	// SlashFraction is the decimal fraction of its stake a misbehaving
+	// validator loses, such as "0.05", none if empty
+	SlashFraction string `json:"slash_fraction,omitempty"`
+	// BlockReward is the native amount in base units minted for each block,
+	// none if unset
+	BlockReward *Amount `json:"block_reward,omitempty"`
+	// RewardRecipients is "proposer", the default, to pay the block reward to
+	// the account of the proposer, or "signers" to split it between the
+	// accounts of the validators that signed the last block by voting power
+	RewardRecipients string `json:"reward_recipients,omitempty"`
+	// MaxSupply caps the native supply block rewards can mint, none if unset
+	MaxSupply *Amount `json:"max_supply,omitempty"`
+	// InvariantInterval is the number of blocks between invariant checks,
+	// defaultInvariantInterval if unset
+	InvariantInterval int64 `json:"invariant_interval,omitempty"`
+}
+
+var params = Params{}
+
+// setParams updates the chain parameters and writes them to the ongoing block
+func (app *KVStoreApplication) setParams(p Params) error {
+	prev := params
+	app.journal(func() { params = prev })
+	params = p
+	if err := app.onGoingBlock.Set(paramsKey, encodeParams(p)); err != nil {
+		return fmt.Errorf("writing params: %w", err)
+	}
+	return nil
+}
+
+func encodeParams(p Params) []byte {
+	value, err := json.Marshal(p)
+	if err != nil {
+		log.Panicf("Error encoding params: %v", err)
+	}
+	return value
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+
+	"test/db"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	cmttypes "github.com/cometbft/cometbft/types"
+)
+
+// Keys of the max_bytes and max_gas consensus params, which CometBFT only
+// sends in InitChain
+var (
+	maxBytesKey = []byte("meta/max_bytes")
+	maxGasKey   = []byte("meta/max_gas")
+)
+
+// proposalTx is a mempool transaction considered for a proposal
+type proposalTx struct {
+	tx    []byte
+	index int
+	// sender is the fee payer, or else the signer of the first message
+	sender string
+	fee    Amount
+	gas    int64
+}
+
+// outbids reports whether p pays a higher gas price than other, the earlier
+// transaction winning ties
+func (p *proposalTx) outbids(other *proposalTx) bool {
+	// p.fee / p.gas > other.fee / other.gas, without dividing
+	price := new(big.Int).Mul(p.fee.bigInt(), big.NewInt(other.gas))
+	otherPrice := new(big.Int).Mul(other.fee.bigInt(), big.NewInt(p.gas))
+	if c := price.Cmp(otherPrice); c != 0 {
+		return c > 0
+	}
+	return p.index < other.index
+}
+
+// parseProposalTx decodes a mempool transaction, returning false if it can't
+// be included in any block
+func parseProposalTx(tx []byte, index int) (*proposalTx, bool) {
+	var transaction Transaction
+	if err := transaction.FromBytes(tx); err != nil {
+		return nil, false
+	}
+	gas, ok := txGasWanted(tx)
+	if !ok {
+		return nil, false
+	}
+	p := &proposalTx{tx: tx, index: index, sender: transaction.Msgs[0].Signer(), gas: gas}
+	if transaction.Fee != nil {
+		p.sender = transaction.Fee.Payer
+		// An invalid fee fails the simulation and drops the transaction
+		p.fee, _ = ParseAmount(transaction.Fee.Amount, params.Decimals)
+	}
+	return p, true
+}
+
+// setBlockLimits records the max_bytes and max_gas consensus params in the
+// ongoing block
+func (app *KVStoreApplication) setBlockLimits(maxBytes, maxGas int64) error {
+	app.maxBlockBytes, app.maxBlockGas = maxBytes, maxGas
+	if err := app.onGoingBlock.Set(maxBytesKey, []byte(strconv.FormatInt(maxBytes, 10))); err != nil {
+		return fmt.Errorf("writing max bytes: %w", err)
+	}
+	if err := app.onGoingBlock.Set(maxGasKey, []byte(strconv.FormatInt(maxGas, 10))); err != nil {
+		return fmt.Errorf("writing max gas: %w", err)
+	}
+	return nil
+}
+
+// loadBlockLimits restores the block limits written at InitChain
+func (app *KVStoreApplication) loadBlockLimits() error {
+	for key, limit := range map[string]*int64{string(maxBytesKey): &app.maxBlockBytes, string(maxGasKey): &app.maxBlockGas} {
+		value, err := app.db.Get([]byte(key))
+		if errors.Is(err, db.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if *limit, err = strconv.ParseInt(string(value), 10, 64); err != nil {
+			return fmt.Errorf("invalid stored %s %q: %w", key, value, err)
+		}
+	}
+	return nil
+}
+
+// blockMaxBytes returns the max_bytes consensus param, resolving its default
+func (app *KVStoreApplication) blockMaxBytes() int64 {
+	if app.maxBlockBytes < 0 {
+		return cmttypes.MaxBlockSizeBytes
+	}
+	return app.maxBlockBytes
+}
+
+// fitsGas reports whether gas more fits in a block that already uses used
+func (app *KVStoreApplication) fitsGas(used, gas int64) bool {
+	return app.maxBlockGas < 0 || gas <= app.maxBlockGas-used
+}
+
+// blockGasLeft returns the gas left in a block that already uses used, -1 if
+// the block has no gas limit
+func (app *KVStoreApplication) blockGasLeft(used int64) int64 {
+	if app.maxBlockGas < 0 {
+		return -1
+	}
+	return app.maxBlockGas - used
+}
+
+// senderQueues groups transactions by sender, keeping their order
+func senderQueues(txs []*proposalTx) map[string][]*proposalTx {
+	queues := map[string][]*proposalTx{}
+	for _, p := range txs {
+		queues[p.sender] = append(queues[p.sender], p)
+	}
+	return queues
+}
+
+// nextProposalTx returns the queue head paying the highest gas price
+func nextProposalTx(queues map[string][]*proposalTx) *proposalTx {
+	var best *proposalTx
+	for _, queue := range queues {
+		if best == nil || queue[0].outbids(best) {
+			best = queue[0]
+		}
+	}
+	return best
+}
+
+// popProposalTx removes the head of a sender's queue
+func popProposalTx(queues map[string][]*proposalTx, sender string) {
+	if queues[sender] = queues[sender][1:]; len(queues[sender]) == 0 {
+		delete(queues, sender)
+	}
+}
+
+// simulationTx discards the writes of transactions run for a proposal
+type simulationTx struct{}
+
+func (simulationTx) Set(key []byte, value []byte) error { return nil }
+
+func (simulationTx) Delete(key []byte) error { return nil }
+
+func (simulationTx) Commit() error { return nil }
+
+func (simulationTx) Rollback() error { return nil }
+
+// simulate makes blocks run on a copy of the state, as FinalizeBlock will run
+// them, until the returned function restores the state
+func (app *KVStoreApplication) simulate() func() {
+	snapshot := snapshotState()
+	onGoingBlock := app.onGoingBlock
+	validatorUpdates, keyRotations := app.validatorUpdates, app.keyRotations
+	maxBlockBytes, maxBlockGas := app.maxBlockBytes, app.maxBlockGas
+	app.onGoingBlock = simulationTx{}
+	return func() {
+		snapshot.restore()
+		app.onGoingBlock = onGoingBlock
+		app.validatorUpdates, app.keyRotations = validatorUpdates, keyRotations
+		app.maxBlockBytes, app.maxBlockGas = maxBlockBytes, maxBlockGas
+	}
+}
+
+// commitInfo returns the votes of an extended commit without their extensions
+func commitInfo(extended abcitypes.ExtendedCommitInfo) abcitypes.CommitInfo {
+	info := abcitypes.CommitInfo{Round: extended.Round}
+	for _, vote := range extended.Votes {
+		info.Votes = append(info.Votes, abcitypes.VoteInfo{Validator: vote.Validator, BlockIdFlag: vote.BlockIdFlag})
+	}
+	return info
+}
+
+// prepareTxs orders the mempool transactions by gas price, keeping the order
+// of each sender's transactions, and keeps those that succeed when run in that
+// order and fit in the block's byte and gas limits. Once a sender's
+// transaction is left out, so are its later ones, which ProcessProposal relies
+// on to check the order.
+func (app *KVStoreApplication) prepareTxs(proposal *abcitypes.PrepareProposalRequest) ([][]byte, error) {
+	var candidates []*proposalTx
+	for i, tx := range proposal.Txs {
+		// The oracle transaction is built below from the last commit
+		if isOracleTx(tx) {
+			continue
+		}
+		if p, ok := parseProposalTx(tx, i); ok {
+			candidates = append(candidates, p)
+		}
+	}
+	queues := senderQueues(candidates)
+
+	defer app.simulate()()
+	if _, err := app.beginBlock(proposal.Height, proposal.Time, proposal.Misbehavior); err != nil {
+		return nil, err
+	}
+	collector := feeRecipient(proposal.ProposerAddress)
+
+	var txs [][]byte
+	var size, gas int64
+	// The vote extensions of the last block come first
+	if tx := oracleTx(proposal.LocalLastCommit); tx != nil {
+		if txSize := cmttypes.ComputeProtoSizeForTxs([]cmttypes.Tx{tx}); txSize <= proposal.MaxTxBytes {
+			if _, err := app.executeOracleTx(tx, proposal.Height); err != nil {
+				return nil, err
+			}
+			txs = append(txs, tx)
+			size += txSize
+		}
+	}
+	for len(queues) > 0 {
+		best := nextProposalTx(queues)
+		popProposalTx(queues, best.sender)
+
+		txSize := cmttypes.ComputeProtoSizeForTxs([]cmttypes.Tx{best.tx})
+		if size+txSize > proposal.MaxTxBytes || !app.fitsGas(gas, best.gas) {
+			delete(queues, best.sender)
+			continue
+		}
+		result, err := app.executeTx(best.tx, collector, proposal.Time, app.blockGasLeft(gas))
+		if err != nil {
+			return nil, err
+		}
+		if result.Code != 0 {
+			delete(queues, best.sender)
+			continue
+		}
+		size += txSize
+		gas += result.GasWanted
+		txs = append(txs, best.tx)
+	}
+	if _, _, _, err := app.endBlock(proposal.Height, proposal.ProposerAddress, commitInfo(proposal.LocalLastCommit)); err != nil {
+		return nil, err
+	}
+	return txs, nil
+}
+
+// checkProposal verifies that a proposal could have been built by
+// prepareTxs: the vote extensions it carries are valid, every transaction is
+// well formed and succeeds, the block fits in its byte and gas limits, and
+// each transaction pays the highest gas price among the next transactions of
+// every sender.
+func (app *KVStoreApplication) checkProposal(proposal *abcitypes.ProcessProposalRequest) error {
+	txs := proposal.Txs
+	var oracle []byte
+	if len(txs) > 0 && isOracleTx(txs[0]) {
+		if err := app.verifyOracleTx(txs[0], proposal.Height); err != nil {
+			return fmt.Errorf("vote extensions: %w", err)
+		}
+		oracle, txs = txs[0], txs[1:]
+	}
+	candidates := make([]*proposalTx, len(txs))
+	for i, tx := range txs {
+		p, ok := parseProposalTx(tx, i)
+		if !ok {
+			return fmt.Errorf("transaction %d is malformed or over its gas limit", i)
+		}
+		candidates[i] = p
+	}
+	if size := cmttypes.ComputeProtoSizeForTxs(cmttypes.ToTxs(proposal.Txs)); size > app.blockMaxBytes() {
+		return fmt.Errorf("transactions take %d bytes, more than the block limit of %d", size, app.blockMaxBytes())
+	}
+	queues := senderQueues(candidates)
+
+	defer app.simulate()()
+	if _, err := app.beginBlock(proposal.Height, proposal.Time, proposal.Misbehavior); err != nil {
+		return err
+	}
+	if oracle != nil {
+		if _, err := app.executeOracleTx(oracle, proposal.Height); err != nil {
+			return err
+		}
+	}
+	collector := feeRecipient(proposal.ProposerAddress)
+
+	var gas int64
+	for i, p := range candidates {
+		if best := nextProposalTx(queues); best != p {
+			return fmt.Errorf("transaction %d pays a lower gas price than transaction %d", i, best.index)
+		}
+		popProposalTx(queues, p.sender)
+
+		if !app.fitsGas(gas, p.gas) {
+			return fmt.Errorf("transaction %d takes the block over its gas limit of %d", i, app.maxBlockGas)
+		}
+		result, err := app.executeTx(p.tx, collector, proposal.Time, app.blockGasLeft(gas))
+		if err != nil {
+			return err
+		}
+		if result.Code != 0 {
+			return fmt.Errorf("transaction %d fails: %s", i, result.Log)
+		}
+		gas += result.GasWanted
+	}
+	if _, _, _, err := app.endBlock(proposal.Height, proposal.ProposerAddress, proposal.ProposedLastCommit); err != nil {
+		return err
+	}
+	return nil
+}
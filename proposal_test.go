@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"maps"
+	"testing"
+	"time"
+
+	"test/db"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	cmtproto "github.com/cometbft/cometbft/api/cometbft/types/v1"
+)
+
+// newProposalApp returns an app past the genesis of testGenesis, with a block
+// gas limit of maxGas, -1 for none
+func newProposalApp(t *testing.T, maxGas int64) (*KVStoreApplication, db.DB) {
+	t.Helper()
+	database, err := db.NewPebbleDB(t.TempDir(), db.PebbleOptions{LogLevel: "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	app, err := NewKVStoreApplication(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := testGenesis(t)
+	genesis.ConsensusParams = &cmtproto.ConsensusParams{Block: &cmtproto.BlockParams{MaxBytes: -1, MaxGas: maxGas}}
+	if _, err := app.InitChain(context.Background(), genesis); err != nil {
+		t.Fatal(err)
+	}
+	return app, database
+}
+
+// storedState returns every key and value of database
+func storedState(t *testing.T, database db.DB) map[string][]byte {
+	t.Helper()
+	stored := map[string][]byte{}
+	err := database.Iterate(nil, func(key, value []byte) error {
+		stored[string(key)] = bytes.Clone(value)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+// checkStateUnchanged fails if the state of app, in memory or in database,
+// differs from before
+func checkStateUnchanged(t *testing.T, app *KVStoreApplication, database db.DB, before, stored map[string][]byte) {
+	t.Helper()
+	if !maps.EqualFunc(stateEntries(), before, bytes.Equal) {
+		t.Fatal("the proposal changed the state in memory")
+	}
+	if !maps.EqualFunc(storedState(t, database), stored, bytes.Equal) {
+		t.Fatal("the proposal changed the stored state")
+	}
+	if !bytes.Equal(app.stateHash.sum(), hashState(before)) {
+		t.Fatal("the proposal changed the state hash")
+	}
+}
+
+// proposalGas returns the gas used by txs when executed in a block
+func proposalGas(t *testing.T, txs ...[]byte) int64 {
+	t.Helper()
+	app, _ := newProposalApp(t, -1)
+	res, err := app.FinalizeBlock(context.Background(), &abcitypes.FinalizeBlockRequest{Txs: txs, Height: 1, Time: time.Unix(1_700_000_000, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gas int64
+	for _, result := range res.TxResults {
+		gas += result.GasWanted
+	}
+	return gas
+}
+
+func TestProcessProposal(t *testing.T) {
+	low := transferTx("a", "1", "2", "100", "1")
+	high := transferTx("b", "1", "2", "100", "50")
+	mid := transferTx("c", "2", "1", "100", "10")
+	overdraw := transferTx("d", "2", "1", "5000", "20")
+	oracle := append([]byte("oracle="), mid...)
+
+	blockGas := proposalGas(t, mid, low)
+
+	transfer := &Transfer{Id: "e", Sender: "2", Dest: "1", Amount: "100"}
+	fee := &Fee{Payer: "2", Amount: "10", GasLimit: "1", msgs: []Msg{transfer}}
+	gasLimited := []byte("e=2=1=100=" + sign("2", transfer.Challenge()) + ":fee=2=10=1=" + sign("2", fee.Challenge()))
+
+	accept, reject := abcitypes.PROCESS_PROPOSAL_STATUS_ACCEPT, abcitypes.PROCESS_PROPOSAL_STATUS_REJECT
+	tests := []struct {
+		name   string
+		maxGas int64
+		txs    [][]byte
+		want   abcitypes.ProcessProposalStatus
+	}{
+		{"empty", -1, nil, accept},
+		{"by gas price, in sender order", -1, [][]byte{mid, low, high}, accept},
+		{"malformed", -1, [][]byte{mid, []byte("garbage")}, reject},
+		{"lower gas price first", -1, [][]byte{low, mid, high}, reject},
+		{"failing", -1, [][]byte{overdraw}, reject},
+		{"within the block gas", blockGas, [][]byte{mid, low}, accept},
+		{"over the block gas", blockGas - 1, [][]byte{mid, low}, reject},
+		{"over its own gas limit", -1, [][]byte{gasLimited}, reject},
+		{"user transaction with the oracle prefix first", -1, [][]byte{oracle}, reject},
+		{"user transaction with the oracle prefix", -1, [][]byte{mid, oracle}, reject},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, database := newProposalApp(t, tt.maxGas)
+			before, stored := stateEntries(), storedState(t, database)
+
+			res, err := app.ProcessProposal(context.Background(), &abcitypes.ProcessProposalRequest{
+				Txs:    tt.txs,
+				Height: 1,
+				Time:   time.Unix(1_700_000_000, 0),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Status != tt.want {
+				t.Fatalf("status %s, want %s", res.Status, tt.want)
+			}
+			checkStateUnchanged(t, app, database, before, stored)
+		})
+	}
+}
+
+func TestPrepareProposal(t *testing.T) {
+	low := transferTx("a", "1", "2", "100", "1")
+	high := transferTx("b", "1", "2", "100", "50")
+	mid := transferTx("c", "2", "1", "100", "10")
+	overdraw := transferTx("d", "2", "1", "5000", "20")
+	oracle := append([]byte("oracle="), mid...)
+
+	app, database := newProposalApp(t, -1)
+	before, stored := stateEntries(), storedState(t, database)
+	ctx := context.Background()
+	blockTime := time.Unix(1_700_000_000, 0)
+
+	prepared, err := app.PrepareProposal(ctx, &abcitypes.PrepareProposalRequest{
+		Txs:        [][]byte{low, high, oracle, mid, overdraw, []byte("garbage")},
+		MaxTxBytes: 1 << 20,
+		Height:     1,
+		Time:       blockTime,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStateUnchanged(t, app, database, before, stored)
+
+	// The failing, malformed and oracle-prefixed transactions are left out
+	want := [][]byte{mid, low, high}
+	if len(prepared.Txs) != len(want) {
+		t.Fatalf("prepared %d transactions, want %d", len(prepared.Txs), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(prepared.Txs[i], want[i]) {
+			t.Fatalf("transaction %d is %s, want %s", i, prepared.Txs[i], want[i])
+		}
+	}
+
+	res, err := app.ProcessProposal(ctx, &abcitypes.ProcessProposalRequest{Txs: prepared.Txs, Height: 1, Time: blockTime})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != abcitypes.PROCESS_PROPOSAL_STATUS_ACCEPT {
+		t.Fatalf("the prepared proposal is rejected")
+	}
+	checkStateUnchanged(t, app, database, before, stored)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	cmtproto "github.com/cometbft/cometbft/api/cometbft/types/v1"
+)
+
+// Recipients of the block reward
+const (
+	rewardProposer = "proposer"
+	rewardSigners  = "signers"
+)
+
+// blockReward returns the native amount minted for a block, capped so that
+// the supply stays within the max_supply param
+func blockReward() Amount {
+	if params.BlockReward == nil {
+		return Amount{}
+	}
+	reward := *params.BlockReward
+	if params.MaxSupply == nil {
+		return reward
+	}
+	supply := supplyMap[nativeDenom()]
+	issued, err := supply.Genesis.Add(supply.Minted)
+	if err != nil {
+		return Amount{}
+	}
+	current, err := issued.Sub(supply.Burned)
+	if err != nil {
+		return Amount{}
+	}
+	room, err := params.MaxSupply.Sub(current)
+	if err != nil {
+		return Amount{}
+	}
+	if room.Cmp(reward) < 0 {
+		return room
+	}
+	return reward
+}
+
+// rewardShare is the part of the block reward earned by a validator
+type rewardShare struct {
+	address string
+	account string
+	amount  Amount
+}
+
+// rewardShares splits reward between the proposer of the block or the
+// validators that signed the last one, by voting power. Validators without an
+// operator account in the params earn nothing.
+func rewardShares(reward Amount, proposer []byte, lastCommit abcitypes.CommitInfo) []rewardShare {
+	if reward.IsZero() {
+		return nil
+	}
+	if params.RewardRecipients != rewardSigners {
+		address := strings.ToUpper(hex.EncodeToString(proposer))
+		return []rewardShare{{address: address, account: params.ValidatorAccounts[address], amount: reward}}
+	}
+
+	var signers []abcitypes.VoteInfo
+	total := new(big.Int)
+	for _, vote := range lastCommit.Votes {
+		if vote.BlockIdFlag == cmtproto.BlockIDFlagCommit && vote.Validator.Power > 0 {
+			signers = append(signers, vote)
+			total.Add(total, big.NewInt(vote.Validator.Power))
+		}
+	}
+	shares := make([]rewardShare, 0, len(signers))
+	for _, vote := range signers {
+		// Rounded down, the remainder is not minted
+		n := new(big.Int).Mul(reward.bigInt(), big.NewInt(vote.Validator.Power))
+		amount, err := amountFromBig(n.Quo(n, total))
+		if err != nil {
+			continue
+		}
+		address := strings.ToUpper(hex.EncodeToString(vote.Validator.Address))
+		shares = append(shares, rewardShare{address: address, account: params.ValidatorAccounts[address], amount: amount})
+	}
+	return shares
+}
+
+// distributeRewards mints the block reward to the operator accounts of the
+// validators earning it
+func (app *KVStoreApplication) distributeRewards(proposer []byte, lastCommit abcitypes.CommitInfo) ([]abcitypes.Event, error) {
+	var events []abcitypes.Event
+	denom := nativeDenom()
+	for _, share := range rewardShares(blockReward(), proposer, lastCommit) {
+		if _, ok := keyMap[share.account]; !ok || share.amount.IsZero() {
+			continue
+		}
+		if err := app.mint(denom, share.amount); err != nil {
+			return nil, fmt.Errorf("minting reward of validator %s: %w", share.address, err)
+		}
+		if err := app.credit(denom, share.account, share.amount); err != nil {
+			return nil, fmt.Errorf("crediting reward of validator %s: %w", share.address, err)
+		}
+		events = append(events, abcitypes.Event{
+			Type: "reward",
+			Attributes: []abcitypes.EventAttribute{
+				{Key: "validator", Value: share.address, Index: true},
+				{Key: "account", Value: share.account, Index: true},
+				{Key: "amount", Value: share.amount.Format(params.Decimals), Index: false},
+			},
+		})
+	}
+	return events, nil
+}
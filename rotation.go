@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+
+	"test/apperrors"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+)
+
+// RotateKey replaces the public key of an account from the next block. It is
+// signed by the current key, and optionally by the new one over the same
+// challenge to prove it is held.
+type RotateKey struct {
+	Id      string `json:"id"`
+	Account string `json:"account"`
+	// PubKey is the new key, a single key or a multisig key set
+	PubKey    string `json:"pub_key"`
+	Signature string `json:"signature"`
+	// NewSignature is the signature of the new key, empty if not given
+	NewSignature string `json:"new_signature,omitempty"`
+}
+
+// parseRotateKey decodes rotate=id=account=pub_key=signature, or
+// rotate=id=account=pub_key=signature=new_signature.
+func parseRotateKey(parts [][]byte) Msg {
+	if len(parts) != 5 && len(parts) != 6 {
+		return nil
+	}
+	r := &RotateKey{
+		Id:        string(parts[1]),
+		Account:   string(parts[2]),
+		PubKey:    string(parts[3]),
+		Signature: string(parts[4]),
+	}
+	if len(parts) == 6 {
+		r.NewSignature = string(parts[5])
+	}
+	return r
+}
+
+func (r *RotateKey) Signer() string { return r.Account }
+
+func (r *RotateKey) Sig() string { return r.Signature }
+
+func (r *RotateKey) Challenge() []byte {
+	challenge := []byte("rotate")
+	challenge = append(challenge, []byte(r.Id)...)
+	challenge = append(challenge, []byte(r.Account)...)
+	challenge = append(challenge, []byte(r.PubKey)...)
+	return challenge
+}
+
+func isValidRotateKey(r *RotateKey, ctx *txContext) error {
+	keySet, err := parseKeySet(r.PubKey)
+	if err != nil {
+		return apperrors.ErrInvalidPubKey.Wrapf("%v", err)
+	}
+	if r.PubKey == keyMap[r.Account] {
+		return apperrors.ErrInvalidPubKey.Wrapf("account %s already has this key", r.Account)
+	}
+	if ctx.rotations[r.Account] {
+		return apperrors.ErrDuplicateKeyRotation.Wrapf("account %s", r.Account)
+	}
+	if r.NewSignature != "" {
+		if err := keySet.verify(r.Challenge(), r.NewSignature, ctx.gas); err != nil {
+			return fmt.Errorf("new key: %w", err)
+		}
+	}
+	ctx.rotations[r.Account] = true
+	return nil
+}
+
+func (app *KVStoreApplication) executeRotateKey(r *RotateKey) (abcitypes.Event, error) {
+	// Earlier transactions of the block are still signed with the current key
+	if _, ok := app.keyRotations[r.Account]; ok {
+		return abcitypes.Event{}, apperrors.ErrDuplicateKeyRotation.Wrapf("account %s", r.Account)
+	}
+	journalEntry(app, app.keyRotations, r.Account)
+	app.keyRotations[r.Account] = r.PubKey
+
+	return abcitypes.Event{
+		Type: "key_rotation",
+		Attributes: []abcitypes.EventAttribute{
+			{Key: "account", Value: r.Account, Index: true},
+			{Key: "pub_key", Value: r.PubKey, Index: false},
+		},
+	}, nil
+}
+
+// applyKeyRotations replaces the keys rotated by the block once its
+// transactions have run
+func (app *KVStoreApplication) applyKeyRotations() error {
+	for _, account := range sortedKeys(app.keyRotations) {
+		if err := app.setPubKey(account, app.keyRotations[account]); err != nil {
+			return err
+		}
+	}
+	app.keyRotations = map[string]string{}
+	return nil
+}
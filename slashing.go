@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	cmted25519 "github.com/cometbft/cometbft/crypto/ed25519"
+)
+
+// fractionDecimals is the precision of the slash fraction
+const fractionDecimals = 18
+
+// parseFraction parses a decimal fraction between 0 and 1, such as "0.05"
+func parseFraction(s string) (Amount, error) {
+	fraction, err := ParseAmount(s, fractionDecimals)
+	if err != nil {
+		return Amount{}, err
+	}
+	if fraction.Cmp(fractionOne()) > 0 {
+		return Amount{}, fmt.Errorf("fraction %s is above 1", s)
+	}
+	return fraction, nil
+}
+
+// fractionOne returns the fraction 1 in fractionDecimals
+func fractionOne() Amount {
+	one, _ := amountFromBig(new(big.Int).Exp(big.NewInt(10), big.NewInt(fractionDecimals), nil))
+	return one
+}
+
+// slashFraction returns the fraction of its stake a misbehaving validator
+// loses, none if the params don't set one
+func slashFraction() Amount {
+	if params.SlashFraction == "" {
+		return Amount{}
+	}
+	// The params are validated when they are imported
+	fraction, _ := parseFraction(params.SlashFraction)
+	return fraction
+}
+
+// mulFraction returns amount times fraction, rounded down
+func mulFraction(amount, fraction Amount) Amount {
+	n := new(big.Int).Mul(amount.bigInt(), fraction.bigInt())
+	n.Quo(n, fractionOne().bigInt())
+	// A fraction of at most 1 can't increase the amount
+	product, _ := amountFromBig(n)
+	return product
+}
+
+// processMisbehavior slashes and jails the validators the block has evidence
+// against. Validators are punished once, evidence against a jailed validator
+// is ignored. A validator holding all the voting power is slashed but not
+// jailed, since CometBFT can't run without validators.
+func (app *KVStoreApplication) processMisbehavior(misbehavior []abcitypes.Misbehavior) ([]abcitypes.Event, error) {
+	var events []abcitypes.Event
+	for _, evidence := range misbehavior {
+		address := strings.ToUpper(hex.EncodeToString(evidence.Validator.Address))
+		validator, ok := validatorMap[address]
+		if !ok || validator.Jailed {
+			continue
+		}
+		slashed, err := app.slash(address, slashFraction())
+		if err != nil {
+			return nil, fmt.Errorf("slashing validator %s: %w", address, err)
+		}
+		jailed := checkVotingPower(map[string]int64{address: 0}) == nil
+		if jailed {
+			if err := app.jail(address); err != nil {
+				return nil, fmt.Errorf("jailing validator %s: %w", address, err)
+			}
+		}
+		events = append(events, abcitypes.Event{
+			Type: "slash",
+			Attributes: []abcitypes.EventAttribute{
+				{Key: "validator", Value: address, Index: true},
+				{Key: "reason", Value: misbehaviorReason(evidence.Type), Index: true},
+				{Key: "height", Value: fmt.Sprint(evidence.Height), Index: false},
+				{Key: "amount", Value: slashed.Format(params.Decimals), Index: false},
+				{Key: "jailed", Value: fmt.Sprint(jailed), Index: false},
+			},
+		})
+	}
+	return events, nil
+}
+
+// misbehaviorReason names a type of misbehavior in events
+func misbehaviorReason(t abcitypes.MisbehaviorType) string {
+	switch t {
+	case abcitypes.MISBEHAVIOR_TYPE_DUPLICATE_VOTE:
+		return "duplicate_vote"
+	case abcitypes.MISBEHAVIOR_TYPE_LIGHT_CLIENT_ATTACK:
+		return "light_client_attack"
+	}
+	return "unknown"
+}
+
+// slash burns fraction of every delegation to a validator, lowering its power,
+// and returns the total burned. Unbonding stake is not slashed.
+func (app *KVStoreApplication) slash(address string, fraction Amount) (Amount, error) {
+	var total Amount
+	for _, account := range sortedKeys(delegationMap[address]) {
+		delegation := delegationMap[address][account]
+		cut := mulFraction(delegation, fraction)
+		if cut.IsZero() {
+			continue
+		}
+		remaining, err := delegation.Sub(cut)
+		if err != nil {
+			return Amount{}, err
+		}
+		if err := app.setDelegation(address, account, remaining); err != nil {
+			return Amount{}, err
+		}
+		if total, err = total.Add(cut); err != nil {
+			return Amount{}, err
+		}
+	}
+	if total.IsZero() {
+		return total, nil
+	}
+	stake, err := validatorStake(address).Sub(total)
+	if err != nil {
+		return Amount{}, fmt.Errorf("stake of validator %s is below its delegations: %w", address, err)
+	}
+	// A validator holding all the voting power keeps it, since CometBFT can't
+	// run without validators
+	if checkVotingPower(map[string]int64{address: validatorPower(address, stake)}) != nil {
+		validator := *validatorMap[address]
+		validator.Stake = stake
+		err = app.setValidator(address, &validator)
+	} else {
+		var pubKey []byte
+		if pubKey, err = hex.DecodeString(validatorMap[address].PubKey); err != nil {
+			return Amount{}, fmt.Errorf("invalid public key: %w", err)
+		}
+		err = app.setStake(address, pubKey, stake)
+	}
+	if err != nil {
+		return Amount{}, err
+	}
+	return total, app.burn(nativeDenom(), total)
+}
+
+// jail removes a validator from the set until the admin gives it power again
+func (app *KVStoreApplication) jail(address string) error {
+	validator := *validatorMap[address]
+	removed := validator.Power > 0
+	validator.Jailed = true
+	validator.Power = 0
+	if err := app.setValidator(address, &validator); err != nil {
+		return err
+	}
+	if removed {
+		pubKey, err := hex.DecodeString(validator.PubKey)
+		if err != nil {
+			return fmt.Errorf("invalid public key: %w", err)
+		}
+		app.queueValidatorUpdate(address, abcitypes.ValidatorUpdate{
+			Power:       0,
+			PubKeyType:  cmted25519.KeyType,
+			PubKeyBytes: pubKey,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+
+	"test/apperrors"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	cmted25519 "github.com/cometbft/cometbft/crypto/ed25519"
+	cmttypes "github.com/cometbft/cometbft/types"
+)
+
+// Bond locks Amount of the account's native balance as stake of the validator
+// with the hex encoded ed25519 public key PubKey, which joins the validator
+// set if it isn't in it. The account can use each id once.
+type Bond struct {
+	Id        string `json:"id"`
+	Account   string `json:"account"`
+	PubKey    string `json:"pub_key"`
+	Amount    string `json:"amount"`
+	Signature string `json:"signature"`
+}
+
+// Unbond withdraws Amount of the account's stake from a validator. It returns
+// to the account's balance once the unbonding period has elapsed. The account
+// can use each id once.
+type Unbond struct {
+	Id        string `json:"id"`
+	Account   string `json:"account"`
+	PubKey    string `json:"pub_key"`
+	Amount    string `json:"amount"`
+	Signature string `json:"signature"`
+}
+
+// Unbonding is stake on its way back to an account, stored under
+// unbonding/<completes_at>/<validator>/<account> until it completes.
+type Unbonding struct {
+	Account   string `json:"account"`
+	Validator string `json:"validator"`
+	Amount    Amount `json:"amount"`
+	// CompletesAt is the height of the first block the stake is released in
+	CompletesAt int64 `json:"completes_at"`
+}
+
+// delegationMap holds the stake of each account by validator address, stored
+// under delegation/<validator>/<account>
+var delegationMap = map[string]map[string]Amount{}
+
+// unbondingMap holds the unbondings by completion height, then by
+// delegationKey
+var unbondingMap = map[int64]map[string]Unbonding{}
+
+// parseBond decodes bond=id=account=pubkey=amount=signature.
+func parseBond(parts [][]byte) Msg {
+	if len(parts) != 6 {
+		return nil
+	}
+	return &Bond{
+		Id:        string(parts[1]),
+		Account:   string(parts[2]),
+		PubKey:    string(parts[3]),
+		Amount:    string(parts[4]),
+		Signature: string(parts[5]),
+	}
+}
+
+// parseUnbond decodes unbond=id=account=pubkey=amount=signature.
+func parseUnbond(parts [][]byte) Msg {
+	if len(parts) != 6 {
+		return nil
+	}
+	return &Unbond{
+		Id:        string(parts[1]),
+		Account:   string(parts[2]),
+		PubKey:    string(parts[3]),
+		Amount:    string(parts[4]),
+		Signature: string(parts[5]),
+	}
+}
+
+func (b *Bond) Signer() string { return b.Account }
+
+func (b *Bond) Sig() string { return b.Signature }
+
+func (b *Bond) Challenge() []byte {
+	return []byte(strings.Join([]string{"bond", b.Id, b.Account, b.PubKey, b.Amount}, "="))
+}
+
+func (b *Bond) msgId() (string, string) { return "bond", b.Id }
+
+func (u *Unbond) Signer() string { return u.Account }
+
+func (u *Unbond) Sig() string { return u.Signature }
+
+func (u *Unbond) Challenge() []byte {
+	return []byte(strings.Join([]string{"unbond", u.Id, u.Account, u.PubKey, u.Amount}, "="))
+}
+
+func (u *Unbond) msgId() (string, string) { return "unbond", u.Id }
+
+// powerReduction returns the stake in native base units worth one unit of
+// voting power
+func powerReduction() *big.Int {
+	if params.PowerReduction != nil && !params.PowerReduction.IsZero() {
+		return params.PowerReduction.bigInt()
+	}
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(params.Decimals)), nil)
+}
+
+// stakePower returns the voting power of a validator with stake, more than
+// CometBFT's limit if it doesn't fit
+func stakePower(stake Amount) int64 {
+	power := new(big.Int).Quo(stake.bigInt(), powerReduction())
+	if !power.IsInt64() || power.Int64() > cmttypes.MaxTotalVotingPower {
+		return cmttypes.MaxTotalVotingPower + 1
+	}
+	return power.Int64()
+}
+
+// votingPower returns the power of a validator with basePower and stake, more
+// than CometBFT's limit if it doesn't fit
+func votingPower(basePower int64, stake Amount) int64 {
+	power := stakePower(stake)
+	if power > cmttypes.MaxTotalVotingPower-basePower {
+		return cmttypes.MaxTotalVotingPower + 1
+	}
+	return basePower + power
+}
+
+// validatorPower returns the voting power of a validator with stake on top of
+// its base power, none if it is jailed
+func validatorPower(address string, stake Amount) int64 {
+	validator, ok := validatorMap[address]
+	if !ok {
+		return stakePower(stake)
+	}
+	if validator.Jailed {
+		return 0
+	}
+	return votingPower(validator.BasePower, stake)
+}
+
+// parseStake returns the validator address and amount of a bond or unbond
+func parseStake(pubKeyHex, amount string) (string, Amount, error) {
+	pubKey, err := parseValidatorPubKey(pubKeyHex)
+	if err != nil {
+		return "", Amount{}, err
+	}
+	value, err := ParsePositiveAmount(amount, params.Decimals)
+	if err != nil {
+		return "", Amount{}, apperrors.ErrInvalidAmount.Wrapf("%q: %v", amount, err)
+	}
+	return validatorAddress(pubKey), value, nil
+}
+
+// validatorStake returns the stake bonded to a validator
+func validatorStake(address string) Amount {
+	if validator, ok := validatorMap[address]; ok {
+		return validator.Stake
+	}
+	return Amount{}
+}
+
+// delegationKey returns the key of the stake of account in a validator
+func delegationKey(address, account string) string {
+	return address + "/" + account
+}
+
+func isValidBond(b *Bond, ctx *txContext) error {
+	address, amount, err := parseStake(b.PubKey, b.Amount)
+	if err != nil {
+		return err
+	}
+	if err := ctx.debit(nativeDenom(), b.Account, amount); err != nil {
+		return err
+	}
+	return ctx.stake(address, b.Account, amount, true)
+}
+
+func isValidUnbond(u *Unbond, ctx *txContext) error {
+	address, amount, err := parseStake(u.PubKey, u.Amount)
+	if err != nil {
+		return err
+	}
+	return ctx.stake(address, u.Account, amount, false)
+}
+
+// stake checks that amount can be bonded to or unbonded from a validator on
+// top of the earlier messages and records the change
+func (ctx *txContext) stake(address, account string, amount Amount, bond bool) error {
+	stake, ok := ctx.stakes[address]
+	if !ok {
+		stake = validatorStake(address)
+	}
+	key := delegationKey(address, account)
+	delegation, ok := ctx.delegations[key]
+	if !ok {
+		delegation = delegationMap[address][account]
+	}
+
+	var err error
+	if bond {
+		if stake, err = stake.Add(amount); err != nil {
+			return apperrors.ErrSupplyOverflow.Wrapf("stake of validator %s", address)
+		}
+		if delegation, err = delegation.Add(amount); err != nil {
+			return apperrors.ErrSupplyOverflow.Wrapf("stake of %s in %s", account, address)
+		}
+	} else {
+		if delegation, err = delegation.Sub(amount); err != nil {
+			return apperrors.ErrInsufficientStake.Wrapf("%s has %s bonded in %s, needs %s", account, delegation, address, amount)
+		}
+		if stake, err = stake.Sub(amount); err != nil {
+			return apperrors.ErrInsufficientStake.Wrapf("validator %s has %s bonded, needs %s", address, stake, amount)
+		}
+	}
+	ctx.stakes[address] = stake
+	ctx.delegations[key] = delegation
+	ctx.powers[address] = validatorPower(address, stake)
+	return checkVotingPower(ctx.powers)
+}
+
+func (app *KVStoreApplication) executeBond(b *Bond) (abcitypes.Event, error) {
+	pubKey, err := parseValidatorPubKey(b.PubKey)
+	if err != nil {
+		return abcitypes.Event{}, err
+	}
+	amount, err := parseAmount(b.Amount, params.Decimals)
+	if err != nil {
+		return abcitypes.Event{}, err
+	}
+	address := validatorAddress(pubKey)
+
+	if err := app.debit(nativeDenom(), b.Account, amount); err != nil {
+		return abcitypes.Event{}, err
+	}
+	delegation, err := delegationMap[address][b.Account].Add(amount)
+	if err != nil {
+		return abcitypes.Event{}, apperrors.ErrSupplyOverflow.Wrapf("stake of %s in %s", b.Account, address)
+	}
+	if err := app.setDelegation(address, b.Account, delegation); err != nil {
+		return abcitypes.Event{}, err
+	}
+	stake, err := validatorStake(address).Add(amount)
+	if err != nil {
+		return abcitypes.Event{}, apperrors.ErrSupplyOverflow.Wrapf("stake of validator %s", address)
+	}
+	if err := app.setStake(address, pubKey, stake); err != nil {
+		return abcitypes.Event{}, err
+	}
+
+	return stakeEvent("bond", address, b.Account, amount), nil
+}
+
+func (app *KVStoreApplication) executeUnbond(u *Unbond) (abcitypes.Event, error) {
+	pubKey, err := parseValidatorPubKey(u.PubKey)
+	if err != nil {
+		return abcitypes.Event{}, err
+	}
+	amount, err := parseAmount(u.Amount, params.Decimals)
+	if err != nil {
+		return abcitypes.Event{}, err
+	}
+	address := validatorAddress(pubKey)
+
+	delegation, err := delegationMap[address][u.Account].Sub(amount)
+	if err != nil {
+		return abcitypes.Event{}, apperrors.ErrInsufficientStake.Wrapf("%s has %s bonded in %s, needs %s", u.Account, delegationMap[address][u.Account], address, amount)
+	}
+	if err := app.setDelegation(address, u.Account, delegation); err != nil {
+		return abcitypes.Event{}, err
+	}
+	stake, err := validatorStake(address).Sub(amount)
+	if err != nil {
+		return abcitypes.Event{}, fmt.Errorf("stake of validator %s is below its delegations: %w", address, err)
+	}
+	if err := app.setStake(address, pubKey, stake); err != nil {
+		return abcitypes.Event{}, err
+	}
+
+	completesAt := app.executingHeight() + params.UnbondingBlocks
+	unbonding := unbondingMap[completesAt][delegationKey(address, u.Account)]
+	total, err := unbonding.Amount.Add(amount)
+	if err != nil {
+		return abcitypes.Event{}, apperrors.ErrSupplyOverflow.Wrapf("unbonding of %s", u.Account)
+	}
+	unbonding = Unbonding{Account: u.Account, Validator: address, Amount: total, CompletesAt: completesAt}
+	if err := app.setUnbonding(unbonding); err != nil {
+		return abcitypes.Event{}, err
+	}
+
+	event := stakeEvent("unbond", address, u.Account, amount)
+	event.Attributes = append(event.Attributes, abcitypes.EventAttribute{Key: "completes_at", Value: fmt.Sprint(completesAt), Index: false})
+	return event, nil
+}
+
+// setStake updates the stake of a validator, adding it to the set if needed,
+// and its voting power to match
+func (app *KVStoreApplication) setStake(address string, pubKey []byte, stake Amount) error {
+	validator := &Validator{PubKey: hex.EncodeToString(pubKey)}
+	if existing, ok := validatorMap[address]; ok {
+		copied := *existing
+		validator = &copied
+	}
+	power := validatorPower(address, stake)
+	if err := checkVotingPower(map[string]int64{address: power}); err != nil {
+		return err
+	}
+	changed := power != validator.Power
+	validator.Stake = stake
+	validator.Power = power
+	if err := app.setValidator(address, validator); err != nil {
+		return err
+	}
+	if changed {
+		app.queueValidatorUpdate(address, abcitypes.ValidatorUpdate{
+			Power:       power,
+			PubKeyType:  cmted25519.KeyType,
+			PubKeyBytes: pubKey,
+		})
+	}
+	return nil
+}
+
+// completeUnbondings returns the stake whose unbonding completes by height to
+// its accounts and deletes the unbondings
+func (app *KVStoreApplication) completeUnbondings(height int64) ([]abcitypes.Event, error) {
+	var events []abcitypes.Event
+	for _, completesAt := range sortedKeys(unbondingMap) {
+		if completesAt > height {
+			break
+		}
+		for _, key := range sortedKeys(unbondingMap[completesAt]) {
+			unbonding := unbondingMap[completesAt][key]
+			if err := app.credit(nativeDenom(), unbonding.Account, unbonding.Amount); err != nil {
+				return nil, err
+			}
+			if err := app.deleteUnbonding(unbonding); err != nil {
+				return nil, err
+			}
+			events = append(events, stakeEvent("unbonding_completed", unbonding.Validator, unbonding.Account, unbonding.Amount))
+		}
+	}
+	return events, nil
+}
+
+// setDelegation updates the stake of an account in a validator
+func (app *KVStoreApplication) setDelegation(address, account string, amount Amount) error {
+	if delegationMap[address] == nil {
+		delegationMap[address] = map[string]Amount{}
+	}
+	journalEntry(app, delegationMap[address], account)
+	delegationMap[address][account] = amount
+	if err := app.onGoingBlock.Set([]byte("delegation/"+delegationKey(address, account)), []byte(amount.String())); err != nil {
+		return fmt.Errorf("writing stake of %s in %s: %w", account, address, err)
+	}
+	return nil
+}
+
+// unbondingKey returns the key of the unbondings of account from a validator
+// completing at height, ordered by height
+func unbondingKey(height int64, address, account string) string {
+	return fmt.Sprintf("%020d/%s", height, delegationKey(address, account))
+}
+
+// setUnbonding stores an unbonding
+func (app *KVStoreApplication) setUnbonding(unbonding Unbonding) error {
+	height, key := unbonding.CompletesAt, delegationKey(unbonding.Validator, unbonding.Account)
+	if unbondingMap[height] == nil {
+		journalEntry(app, unbondingMap, height)
+		unbondingMap[height] = map[string]Unbonding{}
+	}
+	journalEntry(app, unbondingMap[height], key)
+	unbondingMap[height][key] = unbonding
+	storeKey := unbondingKey(height, unbonding.Validator, unbonding.Account)
+	if err := app.onGoingBlock.Set([]byte("unbonding/"+storeKey), encodeUnbonding(unbonding)); err != nil {
+		return fmt.Errorf("writing unbonding %s: %w", storeKey, err)
+	}
+	return nil
+}
+
+// deleteUnbonding removes a completed unbonding
+func (app *KVStoreApplication) deleteUnbonding(unbonding Unbonding) error {
+	height, key := unbonding.CompletesAt, delegationKey(unbonding.Validator, unbonding.Account)
+	journalEntry(app, unbondingMap[height], key)
+	delete(unbondingMap[height], key)
+	if len(unbondingMap[height]) == 0 {
+		journalEntry(app, unbondingMap, height)
+		delete(unbondingMap, height)
+	}
+	storeKey := unbondingKey(height, unbonding.Validator, unbonding.Account)
+	if err := app.onGoingBlock.Delete([]byte("unbonding/" + storeKey)); err != nil {
+		return fmt.Errorf("deleting unbonding %s: %w", storeKey, err)
+	}
+	return nil
+}
+
+func encodeUnbonding(unbonding Unbonding) []byte {
+	value, err := json.Marshal(unbonding)
+	if err != nil {
+		log.Panicf("Error encoding unbonding: %v", err)
+	}
+	return value
+}
+
+func stakeEvent(eventType, address, account string, amount Amount) abcitypes.Event {
+	return abcitypes.Event{
+		Type: eventType,
+		Attributes: []abcitypes.EventAttribute{
+			{Key: "validator", Value: address, Index: true},
+			{Key: "account", Value: account, Index: true},
+			{Key: "amount", Value: amount.Format(params.Decimals), Index: true},
+		},
+	}
+}
+
+// queryDelegations returns the stake of account by validator address
+func queryDelegations(account string) (*abcitypes.QueryResponse, error) {
+	delegations := map[string]Amount{}
+	for address, stakes := range delegationMap {
+		if stake := stakes[account]; !stake.IsZero() {
+			delegations[address] = stake
+		}
+	}
+	value, err := json.Marshal(delegations)
+	if err != nil {
+		return nil, fmt.Errorf("encoding delegations: %w", err)
+	}
+	return &abcitypes.QueryResponse{Log: "exists", Value: value}, nil
+}
+
+// queryUnbondings returns the stake of account still unbonding, by completion
+// height
+func queryUnbondings(account string) (*abcitypes.QueryResponse, error) {
+	unbondings := []Unbonding{}
+	for _, height := range sortedKeys(unbondingMap) {
+		for _, key := range sortedKeys(unbondingMap[height]) {
+			if unbonding := unbondingMap[height][key]; unbonding.Account == account {
+				unbondings = append(unbondings, unbonding)
+			}
+		}
+	}
+	value, err := json.Marshal(unbondings)
+	if err != nil {
+		return nil, fmt.Errorf("encoding unbondings: %w", err)
+	}
+	return &abcitypes.QueryResponse{Log: "exists", Value: value}, nil
+}
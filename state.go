@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"test/db"
+
+	cmtproto "github.com/cometbft/cometbft/api/cometbft/types/v1"
+	cmttypes "github.com/cometbft/cometbft/types"
+)
+
+// Keys of the last committed block, written in the same transaction as the
+// block's state changes so that both are always consistent on disk
+var (
+	heightKey  = []byte("meta/height")
+	appHashKey = []byte("meta/apphash")
+)
+
+// loadState restores the ledger state and the last committed block from the
+// database. A fresh database keeps the genesis state. CometBFT replays any
+// block committed after the loaded height, so blocks lost to an unsynced
+// write are re-executed on restart.
+func (app *KVStoreApplication) loadState() error {
+	value, err := app.db.Get(heightKey)
+	if errors.Is(err, db.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if app.height, err = strconv.ParseInt(string(value), 10, 64); err != nil {
+		return fmt.Errorf("invalid stored height %q: %w", value, err)
+	}
+	if app.appHash, err = app.db.Get(appHashKey); err != nil {
+		return err
+	}
+	if err := app.loadBlockLimits(); err != nil {
+		return err
+	}
+	if err := app.loadChainID(); err != nil {
+		return err
+	}
+	if err := app.loadConsensusParams(); err != nil {
+		return err
+	}
+	if err := app.loadSigningSets(); err != nil {
+		return err
+	}
+
+	resetState()
+	// The native denomination is only known once the params are loaded
+	nativeBalances := map[string]Amount{}
+	var nativeSupply Supply
+	err = app.db.Iterate(nil, func(key, value []byte) error {
+		k := string(key)
+		switch {
+		case strings.HasPrefix(k, "meta/"):
+			return nil
+		case k == string(supplyKey):
+			if err := json.Unmarshal(value, &nativeSupply); err != nil {
+				return fmt.Errorf("invalid supply: %w", err)
+			}
+		case strings.HasPrefix(k, "supply/"):
+			var s Supply
+			if err := json.Unmarshal(value, &s); err != nil {
+				return fmt.Errorf("invalid supply %s: %w", k, err)
+			}
+			supplyMap[strings.TrimPrefix(k, "supply/")] = s
+		case k == string(paramsKey):
+			if err := json.Unmarshal(value, &params); err != nil {
+				return fmt.Errorf("invalid params: %w", err)
+			}
+		case strings.HasPrefix(k, "asset/"):
+			var asset Asset
+			if err := json.Unmarshal(value, &asset); err != nil {
+				return fmt.Errorf("invalid asset %s: %w", k, err)
+			}
+			assetMap[strings.TrimPrefix(k, "asset/")] = &asset
+		case strings.HasPrefix(k, "balance/"):
+			denom, account, ok := strings.Cut(strings.TrimPrefix(k, "balance/"), "/")
+			if !ok {
+				return fmt.Errorf("invalid balance key %s", k)
+			}
+			balance, err := ParseAmount(string(value), 0)
+			if err != nil {
+				return fmt.Errorf("invalid balance for %s: %w", k, err)
+			}
+			if balanceMap[denom] == nil {
+				balanceMap[denom] = map[string]Amount{}
+			}
+			balanceMap[denom][account] = balance
+		case strings.HasPrefix(k, "pubkey/"):
+			keyMap[strings.TrimPrefix(k, "pubkey/")] = string(value)
+		case strings.HasPrefix(k, "nonce/"):
+			nonce, err := strconv.ParseUint(string(value), 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid nonce for %s: %w", k, err)
+			}
+			nonceMap[strings.TrimPrefix(k, "nonce/")] = nonce
+		case strings.HasPrefix(k, "msgid/"):
+			height, err := strconv.ParseInt(string(value), 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid message id height for %s: %w", k, err)
+			}
+			msgIdMap[strings.TrimPrefix(k, "msgid/")] = height
+		case strings.HasPrefix(k, "reserved/"):
+			amount, err := ParseAmount(string(value), 0)
+			if err != nil {
+				return fmt.Errorf("invalid reserved balance for %s: %w", k, err)
+			}
+			reservedMap[strings.TrimPrefix(k, "reserved/")] = amount
+		case strings.HasPrefix(k, "validator/"):
+			var validator Validator
+			if err := json.Unmarshal(value, &validator); err != nil {
+				return fmt.Errorf("invalid validator %s: %w", k, err)
+			}
+			validatorMap[strings.TrimPrefix(k, "validator/")] = &validator
+		case strings.HasPrefix(k, "delegation/"):
+			address, account, ok := strings.Cut(strings.TrimPrefix(k, "delegation/"), "/")
+			if !ok {
+				return fmt.Errorf("invalid delegation key %s", k)
+			}
+			amount, err := ParseAmount(string(value), 0)
+			if err != nil {
+				return fmt.Errorf("invalid delegation %s: %w", k, err)
+			}
+			if delegationMap[address] == nil {
+				delegationMap[address] = map[string]Amount{}
+			}
+			delegationMap[address][account] = amount
+		case strings.HasPrefix(k, "unbonding/"):
+			var unbonding Unbonding
+			if err := json.Unmarshal(value, &unbonding); err != nil {
+				return fmt.Errorf("invalid unbonding %s: %w", k, err)
+			}
+			if unbondingMap[unbonding.CompletesAt] == nil {
+				unbondingMap[unbonding.CompletesAt] = map[string]Unbonding{}
+			}
+			unbondingMap[unbonding.CompletesAt][delegationKey(unbonding.Validator, unbonding.Account)] = unbonding
+		case strings.HasPrefix(k, "price/"):
+			var record PriceRecord
+			if err := json.Unmarshal(value, &record); err != nil {
+				return fmt.Errorf("invalid price %s: %w", k, err)
+			}
+			priceMap[strings.TrimPrefix(k, "price/")] = record
+		case strings.HasPrefix(k, "pending/"):
+			var record pendingRecord
+			if err := json.Unmarshal(value, &record); err != nil {
+				return fmt.Errorf("invalid pending transfer %s: %w", k, err)
+			}
+			pendingMap[strings.TrimPrefix(k, "pending/")] = &record
+		default:
+			if validAccountID(k) != nil {
+				return fmt.Errorf("unknown key %q", k)
+			}
+			balance, err := ParseAmount(string(value), 0)
+			if err != nil {
+				return fmt.Errorf("invalid balance for account %s: %w", k, err)
+			}
+			nativeBalances[k] = balance
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	balanceMap[nativeDenom()] = nativeBalances
+	supplyMap[nativeDenom()] = nativeSupply
+	return nil
+}
+
+// resetState empties the in-memory state, dropping the built-in accounts,
+// before it is loaded or imported
+func resetState() {
+	params = Params{}
+	keyMap = map[string]string{}
+	balanceMap = map[string]map[string]Amount{}
+	nonceMap = map[string]uint64{}
+	msgIdMap = map[string]int64{}
+	reservedMap = map[string]Amount{}
+	pendingMap = map[string]*pendingRecord{}
+	assetMap = map[string]*Asset{}
+	supplyMap = map[string]Supply{}
+	validatorMap = map[string]*Validator{}
+	delegationMap = map[string]map[string]Amount{}
+	unbondingMap = map[int64]map[string]Unbonding{}
+	priceMap = map[string]PriceRecord{}
+}
+
+// stateSnapshot is a copy of the in-memory state
+type stateSnapshot struct {
+	params        Params
+	keyMap        map[string]string
+	balanceMap    map[string]map[string]Amount
+	nonceMap      map[string]uint64
+	msgIdMap      map[string]int64
+	reservedMap   map[string]Amount
+	pendingMap    map[string]*pendingRecord
+	assetMap      map[string]*Asset
+	supplyMap     map[string]Supply
+	validatorMap  map[string]*Validator
+	delegationMap map[string]map[string]Amount
+	unbondingMap  map[int64]map[string]Unbonding
+	priceMap      map[string]PriceRecord
+	// consensusUpdate is only set while a block runs
+	consensusUpdate *cmtproto.ConsensusParams
+	consensusParams *cmttypes.ConsensusParams
+	signingSets     map[int64]map[string]SigningValidator
+}
+
+// snapshotState copies the in-memory state so that it can be restored after
+// running transactions that must not be kept
+func snapshotState() stateSnapshot {
+	snapshot := stateSnapshot{
+		params:          params,
+		keyMap:          maps.Clone(keyMap),
+		balanceMap:      make(map[string]map[string]Amount, len(balanceMap)),
+		nonceMap:        maps.Clone(nonceMap),
+		msgIdMap:        maps.Clone(msgIdMap),
+		reservedMap:     maps.Clone(reservedMap),
+		pendingMap:      make(map[string]*pendingRecord, len(pendingMap)),
+		assetMap:        maps.Clone(assetMap),
+		supplyMap:       maps.Clone(supplyMap),
+		validatorMap:    maps.Clone(validatorMap),
+		delegationMap:   make(map[string]map[string]Amount, len(delegationMap)),
+		unbondingMap:    make(map[int64]map[string]Unbonding, len(unbondingMap)),
+		priceMap:        maps.Clone(priceMap),
+		consensusUpdate: consensusUpdate,
+		consensusParams: consensusParams,
+		// The validator sets are replaced rather than updated in place
+		signingSets: maps.Clone(signingSets),
+	}
+	snapshot.params.ValidatorAccounts = maps.Clone(params.ValidatorAccounts)
+	for denom, balances := range balanceMap {
+		snapshot.balanceMap[denom] = maps.Clone(balances)
+	}
+	for address, delegations := range delegationMap {
+		snapshot.delegationMap[address] = maps.Clone(delegations)
+	}
+	for height, unbondings := range unbondingMap {
+		snapshot.unbondingMap[height] = maps.Clone(unbondings)
+	}
+	// Records are updated in place when they are settled
+	for id, record := range pendingMap {
+		copied := *record
+		snapshot.pendingMap[id] = &copied
+	}
+	return snapshot
+}
+
+// restore replaces the in-memory state with the snapshot
+func (s stateSnapshot) restore() {
+	params = s.params
+	keyMap = s.keyMap
+	balanceMap = s.balanceMap
+	nonceMap = s.nonceMap
+	msgIdMap = s.msgIdMap
+	reservedMap = s.reservedMap
+	pendingMap = s.pendingMap
+	assetMap = s.assetMap
+	supplyMap = s.supplyMap
+	validatorMap = s.validatorMap
+	delegationMap = s.delegationMap
+	unbondingMap = s.unbondingMap
+	priceMap = s.priceMap
+	consensusUpdate = s.consensusUpdate
+	consensusParams = s.consensusParams
+	signingSets = s.signingSets
+}
+
+// setPubKey registers the public key of an account
+func (app *KVStoreApplication) setPubKey(account string, pubKey string) error {
+	journalEntry(app, keyMap, account)
+	keyMap[account] = pubKey
+	if err := app.onGoingBlock.Set([]byte("pubkey/"+account), []byte(pubKey)); err != nil {
+		return fmt.Errorf("writing public key of %s: %w", account, err)
+	}
+	return nil
+}
+
+// setNonce updates the number of messages executed for an account
+func (app *KVStoreApplication) setNonce(account string, nonce uint64) error {
+	journalEntry(app, nonceMap, account)
+	nonceMap[account] = nonce
+	if err := app.onGoingBlock.Set([]byte("nonce/"+account), []byte(strconv.FormatUint(nonce, 10))); err != nil {
+		return fmt.Errorf("writing nonce of %s: %w", account, err)
+	}
+	return nil
+}
+
+// setMsgId records the height at which the id of a uniqueMsg was used
+func (app *KVStoreApplication) setMsgId(key string, height int64) error {
+	journalEntry(app, msgIdMap, key)
+	msgIdMap[key] = height
+	if err := app.onGoingBlock.Set([]byte("msgid/"+key), []byte(strconv.FormatInt(height, 10))); err != nil {
+		return fmt.Errorf("writing message id %s: %w", key, err)
+	}
+	return nil
+}
+
+// commitMeta records the block height and app hash in the ongoing block
+func (app *KVStoreApplication) commitMeta(height int64) error {
+	app.height = height
+	app.stateHash.update(app.blockWrites)
+	app.appHash = app.stateHash.sum()
+	if err := app.onGoingBlock.Set(heightKey, []byte(strconv.FormatInt(height, 10))); err != nil {
+		return fmt.Errorf("writing block height: %w", err)
+	}
+	if err := app.onGoingBlock.Set(appHashKey, app.appHash); err != nil {
+		return fmt.Errorf("writing app hash: %w", err)
+	}
+	return nil
+}
+
+// appHash returns a deterministic hash of the ledger state, hashing all of it
+func appHash() []byte {
+	return hashState(stateEntries())
+}
+
+// stateEntries returns the ledger state as the keys and values stored in the database
+func stateEntries() map[string][]byte {
+	entries := make(map[string][]byte, 1+len(supplyMap)+len(assetMap)+len(keyMap)+len(nonceMap)+len(msgIdMap)+len(reservedMap)+len(pendingMap)+len(validatorMap)+len(unbondingMap)+len(priceMap))
+	entries[string(paramsKey)] = encodeParams(params)
+	for denom, s := range supplyMap {
+		entries[supplyStoreKey(denom)] = encodeSupply(s)
+	}
+	for denom, asset := range assetMap {
+		entries["asset/"+denom] = encodeAsset(asset)
+	}
+	for account, pubKey := range keyMap {
+		entries["pubkey/"+account] = []byte(pubKey)
+	}
+	for denom, balances := range balanceMap {
+		for account, balance := range balances {
+			entries[balanceKey(denom, account)] = []byte(balance.String())
+		}
+	}
+	for account, nonce := range nonceMap {
+		entries["nonce/"+account] = []byte(strconv.FormatUint(nonce, 10))
+	}
+	for key, height := range msgIdMap {
+		entries["msgid/"+key] = []byte(strconv.FormatInt(height, 10))
+	}
+	for account, amount := range reservedMap {
+		entries["reserved/"+account] = []byte(amount.String())
+	}
+	for id, record := range pendingMap {
+		entries["pending/"+id] = encodePendingRecord(record)
+	}
+	for address, validator := range validatorMap {
+		entries["validator/"+address] = encodeValidator(validator)
+	}
+	for address, delegations := range delegationMap {
+		for account, amount := range delegations {
+			entries["delegation/"+delegationKey(address, account)] = []byte(amount.String())
+		}
+	}
+	for height, unbondings := range unbondingMap {
+		for _, unbonding := range unbondings {
+			entries["unbonding/"+unbondingKey(height, unbonding.Validator, unbonding.Account)] = encodeUnbonding(unbonding)
+		}
+	}
+	for pair, record := range priceMap {
+		entries["price/"+pair] = encodePriceRecord(record)
+	}
+	return entries
+}
+
+// dbStateEntries reads the ledger state stored in a database
+func dbStateEntries(database db.DB) (map[string][]byte, error) {
+	entries := make(map[string][]byte)
+	err := database.Iterate(nil, func(key, value []byte) error {
+		if !bytes.HasPrefix(key, []byte("meta/")) {
+			entries[string(key)] = value
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// hashState hashes state entries the way the app hash is kept up to date. The
+// app hash of a database can therefore be recomputed from its contents alone,
+// whatever the backend.
+func hashState(entries map[string][]byte) []byte {
+	return newStateHash(entries).sum()
+}
+
+// sortedKeys returns the keys of m in ascending order
+func sortedKeys[K cmp.Ordered, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"strconv"
+	"strings"
+
+	"test/apperrors"
+	"test/db"
+
+	abcitypes "github.com/cometbft/cometbft/abci/types"
+	cmted25519 "github.com/cometbft/cometbft/crypto/ed25519"
+	cmttypes "github.com/cometbft/cometbft/types"
+)
+
+// Validator is a member of the validator set, stored under
+// validator/<address> with its address in upper case hex. Removed validators
+// are kept with no power.
+type Validator struct {
+	// PubKey is the hex encoded ed25519 public key of the validator
+	PubKey string `json:"pub_key"`
+	Power  int64  `json:"power"`
+	// BasePower is the power set in genesis or by the admin, which the power
+	// of the stake adds to
+	BasePower int64 `json:"base_power,omitempty"`
+	// Stake is the native amount bonded to the validator
+	Stake Amount `json:"stake"`
+	// Jailed validators were removed for misbehaving and get no power from
+	// their stake
+	Jailed bool `json:"jailed,omitempty"`
+}
+
+// UpdateValidator adds a validator, changes its base power or removes it with
+// a power of 0, releasing it from jail. It must be signed by the admin account
+// of the params, who can use each id once.
+type UpdateValidator struct {
+	Id string `json:"id"`
+	// PubKey is the hex encoded ed25519 public key of the validator
+	PubKey    string `json:"pub_key"`
+	Power     string `json:"power"`
+	Admin     string `json:"admin"`
+	Signature string `json:"signature"`
+}
+
+// validatorMap holds the validator set by address
+var validatorMap = map[string]*Validator{}
+
+// validatorAddress returns the upper case hex address of an ed25519 public key
+func validatorAddress(pubKey []byte) string {
+	return strings.ToUpper(hex.EncodeToString(cmted25519.PubKey(pubKey).Address()))
+}
+
+// initValidators records the genesis validator set sent in InitChain
+func (app *KVStoreApplication) initValidators(updates []abcitypes.ValidatorUpdate) error {
+	for _, update := range updates {
+		if update.PubKeyType != cmted25519.KeyType || len(update.PubKeyBytes) != cmted25519.PubKeySize {
+			return fmt.Errorf("validator %X: unsupported %s public key", update.PubKeyBytes, update.PubKeyType)
+		}
+		validator := &Validator{PubKey: hex.EncodeToString(update.PubKeyBytes), Power: update.Power, BasePower: update.Power}
+		if err := app.setValidator(validatorAddress(update.PubKeyBytes), validator); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// genesisValidatorUpdates returns the validators with voting power imported
+// from the app_state, for CometBFT to use if the genesis file has none.
+// Otherwise the genesis file must hold the same voting powers.
+func genesisValidatorUpdates(updates []abcitypes.ValidatorUpdate) ([]abcitypes.ValidatorUpdate, error) {
+	powers := map[string]int64{}
+	for _, update := range updates {
+		if update.PubKeyType != cmted25519.KeyType || len(update.PubKeyBytes) != cmted25519.PubKeySize {
+			return nil, fmt.Errorf("validator %X: unsupported %s public key", update.PubKeyBytes, update.PubKeyType)
+		}
+		powers[validatorAddress(update.PubKeyBytes)] = update.Power
+	}
+
+	var set []abcitypes.ValidatorUpdate
+	for _, address := range sortedKeys(validatorMap) {
+		validator := validatorMap[address]
+		if validator.Power == 0 {
+			continue
+		}
+		if power := powers[address]; len(updates) > 0 && power != validator.Power {
+			return nil, fmt.Errorf("validator %s has power %d in the app_state but %d in the genesis file", address, validator.Power, power)
+		}
+		delete(powers, address)
+		pubKey, _ := hex.DecodeString(validator.PubKey)
+		set = append(set, abcitypes.NewValidatorUpdate(cmted25519.PubKey(pubKey), validator.Power))
+	}
+	if len(powers) > 0 {
+		return nil, fmt.Errorf("validator %s of the genesis file has no power in the app_state", sortedKeys(powers)[0])
+	}
+	if len(updates) > 0 {
+		return nil, nil
+	}
+	return set, nil
+}
+
+// setValidator updates a member of the validator set and writes it to the
+// ongoing block
+func (app *KVStoreApplication) setValidator(address string, validator *Validator) error {
+	journalEntry(app, validatorMap, address)
+	validatorMap[address] = validator
+	if err := app.onGoingBlock.Set([]byte("validator/"+address), encodeValidator(validator)); err != nil {
+		return fmt.Errorf("writing validator %s: %w", address, err)
+	}
+	return nil
+}
+
+// queueValidatorUpdate records a change of the validator set to return at the
+// end of the block, replacing an earlier change of the same validator
+func (app *KVStoreApplication) queueValidatorUpdate(address string, update abcitypes.ValidatorUpdate) {
+	journalEntry(app, app.validatorUpdates, address)
+	app.validatorUpdates[address] = update
+}
+
+// blockValidatorUpdates returns the changes of the validator set made by the
+// block, ordered by address
+func (app *KVStoreApplication) blockValidatorUpdates() []abcitypes.ValidatorUpdate {
+	var updates []abcitypes.ValidatorUpdate
+	for _, address := range sortedKeys(app.validatorUpdates) {
+		updates = append(updates, app.validatorUpdates[address])
+	}
+	return updates
+}
+
+func encodeValidator(validator *Validator) []byte {
+	value, err := json.Marshal(validator)
+	if err != nil {
+		log.Panicf("Error encoding validator: %v", err)
+	}
+	return value
+}
+
+// checkVotingPower checks that the validator set keeps some voting power,
+// within CometBFT's limit, once the powers by address in changes are applied
+func checkVotingPower(changes map[string]int64) error {
+	var total int64
+	for address, validator := range validatorMap {
+		if _, ok := changes[address]; !ok {
+			total += validator.Power
+		}
+	}
+	for _, power := range changes {
+		if power > cmttypes.MaxTotalVotingPower-total {
+			return apperrors.ErrInvalidValidator.Wrapf("total voting power exceeds %d", cmttypes.MaxTotalVotingPower)
+		}
+		total += power
+	}
+	if total <= 0 {
+		return apperrors.ErrInvalidValidator.Wrapf("the validator set would have no voting power")
+	}
+	return nil
+}
+
+// parseUpdateValidator decodes validator=id=pubkey=power=admin=signature.
+func parseUpdateValidator(parts [][]byte) Msg {
+	if len(parts) != 6 {
+		return nil
+	}
+	return &UpdateValidator{
+		Id:        string(parts[1]),
+		PubKey:    string(parts[2]),
+		Power:     string(parts[3]),
+		Admin:     string(parts[4]),
+		Signature: string(parts[5]),
+	}
+}
+
+func (u *UpdateValidator) Signer() string { return u.Admin }
+
+func (u *UpdateValidator) Sig() string { return u.Signature }
+
+func (u *UpdateValidator) Challenge() []byte {
+	return []byte(strings.Join([]string{"validator", u.Id, u.PubKey, u.Power}, "="))
+}
+
+func (u *UpdateValidator) msgId() (string, string) { return "validator", u.Id }
+
+// parseValidatorPubKey decodes the hex encoded ed25519 public key of a validator
+func parseValidatorPubKey(s string) ([]byte, error) {
+	pubKey, err := hex.DecodeString(s)
+	if err != nil || len(pubKey) != cmted25519.PubKeySize {
+		return nil, apperrors.ErrInvalidValidator.Wrapf("invalid ed25519 public key %q", s)
+	}
+	return pubKey, nil
+}
+
+// parseValidatorUpdate returns the address, public key and power of an update
+func parseValidatorUpdate(u *UpdateValidator) (string, []byte, int64, error) {
+	pubKey, err := parseValidatorPubKey(u.PubKey)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	power, err := strconv.ParseInt(u.Power, 10, 64)
+	if err != nil || power < 0 || power > cmttypes.MaxTotalVotingPower || strconv.FormatInt(power, 10) != u.Power {
+		return "", nil, 0, apperrors.ErrInvalidValidator.Wrapf("invalid power %q", u.Power)
+	}
+	address := validatorAddress(pubKey)
+	if validator, ok := validatorMap[address]; power == 0 && (!ok || (validator.Power == 0 && validator.BasePower == 0)) {
+		return "", nil, 0, apperrors.ErrInvalidValidator.Wrapf("%s is not a validator", address)
+	}
+	return address, pubKey, power, nil
+}
+
+func isValidUpdateValidator(u *UpdateValidator, ctx *txContext) error {
+	if params.Admin == "" || u.Admin != params.Admin {
+		return apperrors.ErrUnauthorized.Wrapf("%s is not the admin", u.Admin)
+	}
+	address, _, power, err := parseValidatorUpdate(u)
+	if err != nil {
+		return err
+	}
+	if _, ok := ctx.powers[address]; ok {
+		return apperrors.ErrInvalidValidator.Wrapf("%s is updated twice", address)
+	}
+	stake, ok := ctx.stakes[address]
+	if !ok {
+		stake = validatorStake(address)
+	}
+	ctx.powers[address] = votingPower(power, stake)
+	return checkVotingPower(ctx.powers)
+}
+
+func (app *KVStoreApplication) executeUpdateValidator(u *UpdateValidator) (abcitypes.Event, error) {
+	// The set may have changed since the message was validated
+	address, pubKey, basePower, err := parseValidatorUpdate(u)
+	if err != nil {
+		return abcitypes.Event{}, err
+	}
+	stake := validatorStake(address)
+	power := votingPower(basePower, stake)
+	if err := checkVotingPower(map[string]int64{address: power}); err != nil {
+		return abcitypes.Event{}, err
+	}
+
+	validator := &Validator{PubKey: u.PubKey, Power: power, BasePower: basePower, Stake: stake}
+	if err := app.setValidator(address, validator); err != nil {
+		return abcitypes.Event{}, err
+	}
+	app.queueValidatorUpdate(address, abcitypes.ValidatorUpdate{
+		Power:       power,
+		PubKeyType:  cmted25519.KeyType,
+		PubKeyBytes: pubKey,
+	})
+
+	return abcitypes.Event{
+		Type: "validator_update",
+		Attributes: []abcitypes.EventAttribute{
+			{Key: "address", Value: address, Index: true},
+			{Key: "pub_key", Value: u.PubKey, Index: false},
+			{Key: "base_power", Value: u.Power, Index: false},
+			{Key: "power", Value: strconv.FormatInt(power, 10), Index: false},
+		},
+	}, nil
+}
+
+// queryValidators returns the validators with voting power by address
+func queryValidators() (*abcitypes.QueryResponse, error) {
+	validators := map[string]*Validator{}
+	for address, validator := range validatorMap {
+		if validator.Power > 0 {
+			validators[address] = validator
+		}
+	}
+	value, err := json.Marshal(validators)
+	if err != nil {
+		return nil, fmt.Errorf("encoding validators: %w", err)
+	}
+	return &abcitypes.QueryResponse{Log: "exists", Value: value}, nil
+}
+
+// signingSetsKey stores the validator sets that sign the last and the next
+// heights. CometBFT applies the updates returned for a block two blocks later,
+// so the set signing a height can differ from validatorMap.
+var signingSetsKey = []byte("meta/signing_sets")
+
+// SigningValidator is a member of the validator set signing a height
+type SigningValidator struct {
+	// PubKey is the hex encoded ed25519 public key of the validator
+	PubKey string `json:"pub_key"`
+	Power  int64  `json:"power"`
+}
+
+// signingSets holds the validator sets by height, from the last committed
+// height to the one two blocks after it
+var signingSets = map[int64]map[string]SigningValidator{}
+
+// signingSet returns the validator set that signs height, nil if unknown
+func signingSet(height int64) map[string]SigningValidator {
+	return signingSets[height]
+}
+
+// initSigningSets records the genesis validator set as the set signing the
+// first two heights
+func (app *KVStoreApplication) initSigningSets(initialHeight int64) error {
+	set := map[string]SigningValidator{}
+	for address, validator := range validatorMap {
+		if validator.Power > 0 {
+			set[address] = SigningValidator{PubKey: validator.PubKey, Power: validator.Power}
+		}
+	}
+	signingSets = map[int64]map[string]SigningValidator{initialHeight: set, initialHeight + 1: set}
+	return app.writeSigningSets()
+}
+
+// recordSigningSet records the set signing height+2, the set of height+1 with
+// the updates returned for height, and forgets the sets before height
+func (app *KVStoreApplication) recordSigningSet(height int64, updates []abcitypes.ValidatorUpdate) error {
+	next := maps.Clone(signingSets[height+1])
+	if next == nil {
+		return fmt.Errorf("validator set of height %d is unknown", height+1)
+	}
+	for _, update := range updates {
+		address := validatorAddress(update.PubKeyBytes)
+		if update.Power == 0 {
+			delete(next, address)
+			continue
+		}
+		next[address] = SigningValidator{PubKey: hex.EncodeToString(update.PubKeyBytes), Power: update.Power}
+	}
+	signingSets[height+2] = next
+	for h := range signingSets {
+		if h < height {
+			delete(signingSets, h)
+		}
+	}
+	return app.writeSigningSets()
+}
+
+func (app *KVStoreApplication) writeSigningSets() error {
+	value, err := json.Marshal(signingSets)
+	if err != nil {
+		return fmt.Errorf("encoding validator sets: %w", err)
+	}
+	if err := app.onGoingBlock.Set(signingSetsKey, value); err != nil {
+		return fmt.Errorf("writing validator sets: %w", err)
+	}
+	return nil
+}
+
+// loadSigningSets restores the validator sets of the last and next heights
+func (app *KVStoreApplication) loadSigningSets() error {
+	signingSets = map[int64]map[string]SigningValidator{}
+	value, err := app.db.Get(signingSetsKey)
+	if errors.Is(err, db.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(value, &signingSets); err != nil {
+		return fmt.Errorf("invalid stored validator sets: %w", err)
+	}
+	return nil
+}